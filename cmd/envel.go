@@ -16,6 +16,8 @@ import (
 	_ "github.com/ppacher/envel/pkg/bindings/metrics/prometheus"
 	_ "github.com/ppacher/envel/pkg/bindings/mqtt"
 	_ "github.com/ppacher/envel/pkg/bindings/platforms/tplink"
+	_ "github.com/ppacher/envel/pkg/bindings/store"
+	_ "github.com/ppacher/envel/pkg/bindings/sun"
 
 	// default lua bindings
 	"github.com/ppacher/envel/pkg/core"
@@ -32,6 +34,9 @@ import (
 var loadPaths = kingpin.Flag("lua-path", "Lua include paths").Short('p').Strings()
 var filePath = kingpin.Arg("file", "Path to the file to execute").String()
 var pluginPaths = kingpin.Flag("plugins", "Path to a plugin file or directory to load on startup").Short('P').Strings()
+var jobTimeout = kingpin.Flag("job-timeout", "Maximum duration a single job may block the event loop (0 to disable)").Default("0s").Duration()
+var queueSize = kingpin.Flag("queue-size", "Maximum number of jobs queued on the event loop (0 for unbounded)").Default("0").Int()
+var queuePolicy = kingpin.Flag("queue-policy", "What to do if the job queue is full").Default("drop-oldest").Enum("block", "drop-oldest", "drop-newest", "coalesce")
 
 func main() {
 	kingpin.Parse()
@@ -63,7 +68,17 @@ func main() {
 		logrus.Debugf("plugin: %s initialized", plugin.Name())
 	}
 
-	l, err := loop.New(&loop.Options{
+	policy, err := loop.ParseOverflowPolicy(*queuePolicy)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	opts := &loop.Options{
+		JobTimeout: *jobTimeout,
+		Queue: loop.QueueOptions{
+			Capacity: *queueSize,
+			Policy:   policy,
+		},
 		InitVM: func(L *lua.LState) error {
 			core.OpenCore(L)
 			signalBinding.OpenSignal(L)
@@ -89,7 +104,9 @@ func main() {
 
 			return err
 		},
-	})
+	}
+
+	l, err := loop.New(opts)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -97,9 +114,19 @@ func main() {
 	l.Start(context.Background())
 
 	exitSig := make(chan os.Signal, 1)
-	signal.Notify(exitSig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(exitSig, syscall.SIGINT, syscall.SIGTERM)
+
+	reloadSig := make(chan os.Signal, 1)
+	signal.Notify(reloadSig, syscall.SIGHUP)
 
-	<-exitSig
+	for running := true; running; {
+		select {
+		case <-reloadSig:
+			l = reload(l, opts)
+		case <-exitSig:
+			running = false
+		}
+	}
 
 	logrus.Info("shutting down")
 
@@ -108,3 +135,26 @@ func main() {
 
 	logrus.Info("shutdown completed")
 }
+
+// reload creates a new loop using opts and replaces current with it. The
+// current loop is stopped, which executes all on_exit handlers and releases
+// timers and subscriptions. If the new loop fails to load, current is kept
+// running and returned
+func reload(current loop.Loop, opts *loop.Options) loop.Loop {
+	logrus.Infof("reloading %s", *filePath)
+
+	next, err := loop.New(opts)
+	if err != nil {
+		logrus.Errorf("failed to reload %s, keeping the current VM: %s", *filePath, err.Error())
+		return current
+	}
+
+	current.Stop()
+	current.Wait()
+
+	next.Start(context.Background())
+
+	logrus.Info("reload completed")
+
+	return next
+}
@@ -1,5 +1,5 @@
 local stream = require("envel.stream")
-local spawn  = require("envel.spawn")
+local tail   = require("envel.tail")
 
 local function split(inputstr, sep)
     if sep == nil then
@@ -16,13 +16,11 @@ return function(cfg)
     if not cfg then cfg = {} end
 
     cfg.log_file = cfg.log_file or '/var/log/dhcpd4.log'
-    cfg.timeout = cfg.timeout or 10 -- TODO(ppacher): doesn't work for non-number values
 
     local function producer(observer)
-        local timer = spawn.watch {
-            -- TODO(ppacher): add support to specify the command
-            cmd = "tail -f " .. cfg.log_file,
-            timeout = cfg.timeout,
+        local t = tail {
+            path = cfg.log_file,
+            poll_interval = cfg.poll_interval,
             line_callback = function(out)
                 if out == nil then return end
 
@@ -59,10 +57,10 @@ return function(cfg)
         -- everyone unsubscribed
         return function()
             -- using a copy we can ensure garbage collection of the
-            -- timer even if something during :stop() wents terribly
+            -- tail even if something during :stop() wents terribly
             --
-            local copy = timer
-            timer = nil
+            local copy = t
+            t = nil
             copy:stop()
         end
     end
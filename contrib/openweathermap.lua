@@ -13,20 +13,20 @@ end
 
 -- updates the current weather information. If `cb` is set to a function
 -- it will be called with the result of the API call as it's first argument
--- TODO(ppacher): add a non-blocking HTTP client that uses callbacks and pre-reads the body
--- currently this method blocks the whole loop
+-- The request is executed in the background and does not block the loop
 function weather_cls:update_current(cb)
-    local res, err = http{
+    http({
         method = "GET",
         url = self:get_current_weather_url(),
         headers = {
             Accept = "application/json",
         }
-    }
+    }, function(res, err)
+        if err ~= nil or res.status_code ~= 200 then
+            print("failed to poll openweathermap.org (status_code="..tostring(res and res.status_code).."): "..(err or res.status))
+            return
+        end
 
-    if err ~= nil or res.status_code ~= 200 then
-        print("failed to poll openweathermap.org (status_code="..tostring(res.status_code).."): "..(err or res.status))
-    else
         local payload = json.decode(res.body:read("*a"))
         self.current = payload
 
@@ -45,8 +45,7 @@ function weather_cls:update_current(cb)
         if type(cb) == 'function' then
             cb(payload)
         end
-
-    end
+    end)
 end
 
 -- watch starts polling the openweathermap API
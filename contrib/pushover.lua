@@ -53,7 +53,7 @@ local function send_message(key, msg)
         url_title = msg.url_title,
     })
 
-    local res, err = http {
+    http({
         method = "POST",
         url = "https://api.pushover.net/1/messages.json",
         --url = "http://postman-echo.com/post",
@@ -61,12 +61,12 @@ local function send_message(key, msg)
             ["Content-Type"] = "application/json",
         },
         body = body,
-    }
-
-    if err ~= nil or res.status_code ~= 200 then
-        print("failed to send notification (status_code="..tostring(res.status_code).."): "..(err or res.status))
-        print(res.body:read("*a"))
-    end
+    }, function(res, err)
+        if err ~= nil or res.status_code ~= 200 then
+            print("failed to send notification (status_code="..tostring(res and res.status_code).."): "..(err or res.status))
+            if res then print(res.body:read("*a")) end
+        end
+    end)
 end
 
 local pushover_cls = {}
@@ -10,7 +10,7 @@ function sensor_class:emit_signal(...)
 end
 
 function sensor_class:connect_signal(...)
-    self.signal:connect_signal(unpack(arg))
+    return self.signal:connect_signal(unpack(arg))
 end
 
 -- registers the sensor at the hosting application
@@ -1,3 +1,14 @@
 --- Module envel.http provides access to the HTTP client bindings
+--
+-- @usage
+--      local http = require("envel.http")
+--
+--      -- blocks the event loop until the response is received
+--      local res, err = http{method = "GET", url = "http://example.com"}
+--
+--      -- executes the request in the background
+--      http({method = "GET", url = "http://example.com"}, function(res, err)
+--          print(res.status_code, res.body:read("*a"))
+--      end)
 
-return require("envel.bindings.http")
\ No newline at end of file
+return require("envel.bindings.http")
@@ -1,9 +1,14 @@
 -- Module envel provides access to native bindings provided by envel
 return {
     signal = require("envel.signal"),
+    loop = require("envel.loop"),
     timer = require("envel.timer"),
+    sun = require("envel.sun"),
+    scheduler = require("envel.scheduler"),
+    store = require("envel.store"),
     reader = require("envel.reader"),
     spawn = require("envel.spawn"),
+    tail = require("envel.tail"),
     utils = require("envel.utils"),
     device = require("envel.device"),
     rules = require("envel.rules"),
@@ -0,0 +1,25 @@
+--- Module envel.loop provides access to the event loop
+--
+-- The loop emits the following signals:
+--
+-- * **loop::job_timeout** (source, duration): A job exceeded the configured
+--   deadline and has been interrupted
+-- * **envel::error** (message, source, traceback, origin): A job or callback
+--   failed with a Lua error or a panic inside a native binding. source is the
+--   location of the failing function ("script.lua:12") and origin describes
+--   what invoked it (e.g. "mqtt:home/+/status", "signal:item::changed" or
+--   "timer"). Failures are also counted in the jobs_failed_total metric
+--
+-- Functions can be scheduled on the loop using the global
+-- `__schedule(fn, [priority])` where priority is one of "high", "normal"
+-- (default) or "low". High priority tasks are always executed before
+-- normal and low priority ones. `__schedule` returns a handle that
+-- provides `handle:cancel()` and `handle:is_done()`. Cancelling a handle
+-- drops the function if it has not been executed yet.
+--
+-- @usage
+--      require("envel.loop"):connect_signal("loop::job_timeout", function(source, duration)
+--          print("job from "..source.." interrupted after "..duration.." seconds")
+--      end)
+
+return _G.__loop
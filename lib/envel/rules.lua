@@ -132,7 +132,10 @@ setmetatable(module.rules, {
 -- @param cb The callback function to invoke when triggered
 -- @return A function to call to remove the registration
 --
--- @usage: function(cb) return singal:connect_signal("foo", cb) end
+-- @usage: function(cb)
+--             local conn = signal:connect_signal("foo", cb)
+--             return function() conn:disconnect() end
+--         end
 --
 
 --- Returns a trigger function that connects to a signal
@@ -141,9 +144,17 @@ setmetatable(module.rules, {
 -- @return         trigger function
 function module.onSignal(obj, signal)
     return function(cb)
-        obj:connect_signal(signal, cb)
+        local conn = obj:connect_signal(signal, cb)
 
-        return function() obj:disconnect_signal(signal, cb) end
+        return function()
+            -- objects that implement connect_signal in Lua may not
+            -- return a connection handle
+            if conn and conn.disconnect then
+                conn:disconnect()
+            else
+                obj:disconnect_signal(signal, cb)
+            end
+        end
     end
 end
 
@@ -183,6 +194,48 @@ function module.onInterval(interval)
 end
 
 
+--- Returns a trigger function that runs the rule according to a cron
+-- expression (e.g. "45 6 * * 1-5" for every weekday at 06:45)
+-- @param expr          The cron expression
+-- @param timezone      Optional name of the time zone (defaults to local time)
+-- @return             trigger function
+function module.onCron(expr, timezone)
+    return function(cb)
+        local t = require("envel.timer"){
+            schedule = expr,
+            timezone = timezone,
+            callback = cb,
+            autostart = true,
+            call_now = false,
+        }
+
+        return function()
+            t:stop()
+        end
+    end
+end
+
+
+--- Returns a trigger function that runs the rule at a sun event
+-- @param sun           The sun object (see envel.sun)
+-- @param spec          The event with an optional offset (e.g. "sunset - 30min")
+-- @return             trigger function
+function module.onSun(sun, spec)
+    return function(cb)
+        local t = require("envel.timer"){
+            schedule = sun:schedule(spec),
+            callback = cb,
+            autostart = true,
+            call_now = false,
+        }
+
+        return function()
+            t:stop()
+        end
+    end
+end
+
+
 --- Verifies if the provided rule has every thing setup correctly
 -- @param rule  The rule to verify
 -- @return A string describing an error or nil
@@ -0,0 +1,37 @@
+--- Module envel.scheduler executes named one-shot jobs at a given time.
+-- Pending jobs are stored in a file and re-armed after envel restarts so
+-- "turn the boiler off at 18:00" is not lost in between.
+--
+-- Jobs reference a named handler instead of a function as functions cannot
+-- be persisted. Handlers should be registered before the scheduler starts
+-- firing jobs, i.e. in the same script that creates it. If a job fires
+-- before its handler is registered an envel::error is emitted and the job
+-- is kept until the handler is registered. Job arguments must be JSON
+-- serializable.
+--
+-- Jobs that have been missed while envel was not running are executed as
+-- soon as possible if catch_up is set to "run" (the default) and dropped
+-- if it is set to "skip". With max_delay (in seconds) missed jobs that are
+-- overdue for longer are dropped as well.
+--
+-- @usage
+--      local scheduler = require("envel.scheduler"){
+--          path = "/var/lib/envel/jobs.json",
+--          catch_up = "run",
+--          max_delay = 3600,
+--      }
+--
+--      scheduler:handler("boiler_off", function(args, name)
+--          boiler:set_state(args.state)
+--      end)
+--
+--      scheduler:at{name = "boiler", handler = "boiler_off", ["in"] = 3600, args = {state = "off"}}
+--      scheduler:at{name = "boiler", handler = "boiler_off", at = os.time{...}}
+--
+--      for _, job in ipairs(scheduler:list()) do
+--          print(job.name, os.date("%c", job.at))
+--      end
+--
+--      scheduler:cancel("boiler")
+
+return _G.__core.scheduler
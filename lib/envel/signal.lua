@@ -1,4 +1,39 @@
 --- Module signal
+--
+-- Signal names passed to connect_signal may be glob patterns where `*`
+-- matches any sequence of characters and `?` a single one. Handlers of
+-- patterns receive the name of the emitted signal as their first argument:
+--
+--      obj:connect_signal("property::*", function(name, ...)
+--          print(name.." changed")
+--      end)
+--
+-- topics() includes patterns and subscribers(name) counts the handlers of
+-- matching patterns as well.
+--
+-- connect_signal accepts an optional priority as its third argument. Handlers
+-- with a higher priority are called first (defaults to 0).
+--
+-- emit_signal schedules each handler as a separate task on the loop.
+-- emit_signal_sync calls all handlers immediately in the order of their
+-- priority. If a handler returns false the remaining ones are skipped. It
+-- returns a list with a table of the values returned by each handler and
+-- whether propagation has been stopped:
+--
+--      obj:connect_signal("request::turn_on", function() return not is_night() end, 10)
+--      local results, vetoed = obj:emit_signal_sync("request::turn_on")
+--
+-- connect_signal returns a connection handle with `conn:disconnect()` and
+-- `conn:is_connected()`. connect_signal_once works like connect_signal but
+-- disconnects the handler after the first delivery. disconnect_all(name)
+-- removes all handlers of a signal or pattern, or all handlers at all if
+-- name is omitted:
+--
+--      local conn = obj:connect_signal("state::on", function() ... end)
+--      conn:disconnect()
+--
+--      obj:connect_signal_once("ready", function() ... end)
+--      obj:disconnect_all("state::on")
 
 local methods = {}
 
@@ -88,6 +88,7 @@ end
 -- * **description**: An optional description for the new interface
 -- * **items**: An optional table of items exposed by the interface
 -- * **metrics**: An optional default metric type to use for all items.
+-- * **store**: An optional default store to persist the values of all items
 -- * **keywords**: An optional list of keywords that may be used to identify the interface
 --
 -- @tparam table cfg A configuration table, see above for valid properties
@@ -125,6 +126,10 @@ function Interface.create(cfg)
             icfg.metrics = cfg.metrics
         end
 
+        if icfg.store == nil and cfg.store ~= nil then
+            icfg.store = cfg.store
+        end
+
         items[name] = Item.create(name, icfg, intf)
 
         -- forward item signals
@@ -95,6 +95,28 @@ function Item:connect(source)
     end
 end
 
+--- Persists the item's value in a store (see envel.store) and restores
+-- the last known value from it. The value is restored immediately and
+-- saved each time it changes.
+--
+-- @tparam table store The store or store namespace to use
+-- @tparam ?string key An optional key for the item. Defaults to
+--  "<interface>/<item>" or the item name if it does not belong to an interface
+function Item:persist(store, key)
+    if not key then
+        key = self.interface and (self.interface.name .. '/' .. self.name) or self.name
+    end
+
+    local value = store:get(key)
+    if value ~= nil then
+        self:set(value)
+    end
+
+    self:connect_signal('changed', function(new_value)
+        store:set(key, new_value)
+    end)
+end
+
 --- Expose the item's value as metrics
 function Item:expose_metrics(metrics_cfg)
     -- if it's a function we use that directly
@@ -121,6 +143,9 @@ end
 --   this property will just call item:expose_metrics(...)
 -- * **extra**: An optional (JSON serializable) table with metadata for the item
 -- * **keywords**: An optional list of keywords that may be used to identify the item
+-- * **store**: An optional store (see envel.store) to persist the item's value in.
+--   The last known value is restored when the item is created (@see Item:persist)
+-- * **store_key**: An optional key to use for the store
 --
 -- @tparam string name The name for the item
 -- @tparam table cfg The configuration table for the item. See above for valid properties
@@ -149,6 +174,8 @@ function Item.create(name, cfg, intf)
         item:expose_metrics(cfg.metrics)
     end
 
+    if cfg.store then item:persist(cfg.store, cfg.store_key) end
+
     if cfg.source then item:connect(cfg.source) end
 
     return item
@@ -2,11 +2,12 @@
 -- block the event loop of envel
 
 local exec = _G.__core.exec
-local timer = require("envel.timer")
+local supervise = _G.__core.supervisor
+local signal = require("envel.signal")
 
 local spawn = {}
 
-local function call_maybe_shell(cmd, shell, on_done)
+local function call_maybe_shell(cmd, shell, on_done, opts)
     local line_cb = nil
     local done_cb = nil
 
@@ -30,63 +31,154 @@ local function call_maybe_shell(cmd, shell, on_done)
         end
     end
 
-    exec(cmd, shell or false, line_cb, done_cb)
+    return exec(cmd, shell or false, line_cb, done_cb, opts)
+end
+
+-- All functions of this module return a process object that provides
+-- the following methods:
+--
+--   process:pid()           returns the process ID
+--   process:write(data)     writes data to stdin (requires opts.stdin)
+--   process:close_stdin()   closes stdin
+--   process:kill([signal])  sends a signal (name or number, defaults to "TERM")
+--   process:wait([cb])      calls cb(reason, code) once the process exited or
+--                           returns a pending operation for await()
+--   process:resize(rows, cols)  resizes the terminal (requires opts.pty)
+--
+-- The optional opts table supports the following fields:
+--
+--   env              table of additional environment variables
+--   cwd              working directory
+--   timeout          kill the process after the given number of seconds. The
+--                    exit reason is "timeout" in this case
+--   stdin            open a pipe to stdin
+--   stdout_callback  called with raw chunks of stdout data and nil on EOF
+--   stderr_callback  called with raw chunks of stderr data and nil on EOF
+--   shell            the shell used by the *_with_shell functions (e.g. "sh -c").
+--                    Defaults to the shell configured using spawn.set_shell()
+--   pty              run the command on a pseudo-terminal. The output of the
+--                    terminal is passed to stdout_callback and stdin is always
+--                    available. Closing stdin sends an end-of-transmission
+--   rows, cols       the initial size of the terminal
+--
+-- Using pty and stdout_callback, interactive programs can be scripted by
+-- waiting for a prompt and answering it using process:write():
+--
+--      local p
+--      p = spawn("passwd", {
+--          pty = true,
+--          stdout_callback = function(data)
+--              if data and data:match("password:") then p:write(secret.."\n") end
+--          end,
+--      })
+
+-- Sets the shell used to execute commands (e.g. "sh -c"). The command
+-- is passed as the last argument. Defaults to "bash -c" or "/bin/sh -c"
+-- if bash is not available
+function spawn.set_shell(shell)
+    if type(shell) ~= 'string' then
+        error('shell must be a string, got "'..type(shell)..'"')
+    end
+    exec.shell = shell
 end
 
 -- executes a command and calls the on_done callback providing
 -- stdout, stderr, exit reason and exit code
-function spawn.easy_async(cmd, on_done)
-    return call_maybe_shell(cmd, false, on_done)
+function spawn.easy_async(cmd, on_done, opts)
+    return call_maybe_shell(cmd, false, on_done, opts)
 end
 
 -- Like spawn.easy_async but executes the command inside a shell
-function spawn.easy_async_with_shell(cmd, on_done)
-    return call_maybe_shell(cmd, true, on_done)
+function spawn.easy_async_with_shell(cmd, on_done, opts)
+    return call_maybe_shell(cmd, opts and opts.shell or true, on_done, opts)
 end
 
 -- Executes a command and calls on_line for each newline printed to
 -- stdout or stderr. on_done is execute once the command exits and
--- provides the exit reason (exit or signal) and the code/signal
+-- provides the exit reason (exit, signal or timeout) and the code/signal
 -- depending on the reason
-function spawn.with_line_callback(cmd, on_line, on_done)
-    return exec(cmd, false, on_line, on_done)
+function spawn.with_line_callback(cmd, on_line, on_done, opts)
+    return exec(cmd, false, on_line, on_done, opts)
+end
+
+-- Returns a list of all running child processes. Each entry holds the pid,
+-- the command line, the start time as a unix timestamp and the uptime in
+-- seconds. All children are terminated when envel stops: they receive SIGTERM
+-- and are killed if they did not exit within five seconds. Each child runs in
+-- its own process group so processes started by it are terminated as well
+function spawn.children()
+    return exec.children()
 end
 
--- Periodically executes a command
+-- Keeps a long-running command alive and restarts it with an exponential
+-- backoff whenever it exits. Supported arguments:
+--
+--   cmd              the command to execute
+--   shell            execute cmd inside a shell (true or the shell to use)
+--   line_callback    called for each line printed to stdout or stderr
+--   start_callback   called with the PID each time the command started
+--   exit_callback    called with the exit reason and code
+--   backoff          delay before the first restart in seconds (defaults
+--                    to timeout or 1)
+--   max_backoff      maximum delay between two restarts (defaults to 60)
+--   reset_after      reset the backoff once the command has been running
+--                    for the given number of seconds
+--
+-- env, cwd, pty, rows and cols are supported as well (see above). The returned object emits
+-- "process::start" (pid), "process::exit" (reason, code) and "process::restart"
+-- (delay) and provides stop(), is_running() and pid(). The command is
+-- terminated once the object is stopped or envel exits
 function spawn.watch(args)
     local cmd = args.cmd
-    local timeout = args.timeout
     local on_start = args.start_callback
-    local on_line = args.line_callback
     local on_done = args.exit_callback
 
     if type(cmd) ~= 'string' then
         error('cmd must be set to a string, got "'..type(cmd)..'"')
     end
 
-    local t = timer {
-        timeout = timeout,
-        autostart = true,
-        call_now = true,
-        callback = function(t1)
-            -- we stop the timer and restart it once the command finishes
-            -- so we don't run the command multiple times if it takes longer to
-            -- execute than the configured timeout
-            t1:stop()
-
-            if type(on_start) == 'function' then on_start() end
-            spawn.with_line_callback(cmd, on_line, function(...)
-                if type(on_done) == 'function' then on_done(unpack(arg)) end
-                t1:start()
-            end)
-        end
+    local w = {
+        signal = signal(),
+    }
+
+    local supervisor = supervise {
+        cmd = cmd,
+        shell = args.shell or false,
+        env = args.env,
+        cwd = args.cwd,
+        pty = args.pty,
+        rows = args.rows,
+        cols = args.cols,
+        line_callback = args.line_callback,
+        backoff = args.backoff or args.timeout,
+        max_backoff = args.max_backoff,
+        reset_after = args.reset_after,
+        start_callback = function(pid)
+            w.signal:emit_signal("process::start", pid)
+            if type(on_start) == 'function' then on_start(pid) end
+        end,
+        exit_callback = function(reason, code)
+            w.signal:emit_signal("process::exit", reason, code)
+            if type(on_done) == 'function' then on_done(reason, code) end
+        end,
+        restart_callback = function(delay)
+            w.signal:emit_signal("process::restart", delay)
+        end,
     }
-    return t
+
+    function w:stop() supervisor:stop() end
+    function w:is_running() return supervisor:is_running() end
+    function w:pid() return supervisor:pid() end
+    function w:connect_signal(...) return self.signal:connect_signal(unpack(arg)) end
+    function w:connect_signal_once(...) return self.signal:connect_signal_once(unpack(arg)) end
+    function w:disconnect_signal(...) return self.signal:disconnect_signal(unpack(arg)) end
+
+    return w
 end
 
 setmetatable(spawn, {
-    __call = function(_, cmd)
-        return call_maybe_shell(cmd, false, nil)
+    __call = function(_, cmd, opts)
+        return call_maybe_shell(cmd, false, nil, opts)
     end
 })
 
@@ -0,0 +1,30 @@
+--- Module envel.store provides a durable key-value store for state that
+-- should survive restarts. Values must be JSON serializable and are written
+-- atomically to a local file on each change.
+--
+-- Keys are organized in namespaces. Methods called on the store itself use
+-- the "default" namespace. Keys may have a TTL (in seconds) after which they
+-- are removed.
+--
+-- Stores emit the following signals:
+--
+-- * **store::changed** (namespace, key, value, old) for each modification
+-- * **store::changed::<namespace>::<key>** (value, old) for a single key
+--
+-- Expired or deleted keys are reported with a nil value.
+--
+-- @usage
+--      local store = require("envel.store"){path = "/var/lib/envel/state.json"}
+--      local laundry = store:namespace("laundry")
+--
+--      laundry:set("was_running", true)
+--      laundry:set("door_open", true, 300) -- expires after 5 minutes
+--
+--      if laundry:get("was_running", false) then ... end
+--      laundry:delete("was_running")
+--
+--      store:connect_signal("store::changed::laundry::was_running", function(value, old)
+--          print("was_running changed from "..tostring(old).." to "..tostring(value))
+--      end)
+
+return require("envel.bindings.store")
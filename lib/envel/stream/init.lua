@@ -13,10 +13,16 @@ local function from_signal(obj, signal)
             observer:next(...)
         end
 
-        obj:connect_signal(signal, handle)
+        local conn = obj:connect_signal(signal, handle)
 
         return function()
-            obj:disconnect_signal(signal, handle)
+            -- objects that implement connect_signal in Lua may not
+            -- return a connection handle
+            if conn and conn.disconnect then
+                conn:disconnect()
+            else
+                obj:disconnect_signal(signal, handle)
+            end
         end
     end)
 end
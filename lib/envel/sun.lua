@@ -0,0 +1,22 @@
+--- Module envel.sun calculates sunrise, sunset, dawn and dusk times as
+-- well as the position of the sun for a fixed location without network
+-- access
+--
+-- Supported events are astronomical_dawn, nautical_dawn, civil_dawn (dawn),
+-- sunrise, noon, sunset, civil_dusk (dusk), nautical_dusk and astronomical_dusk.
+-- Events may be combined with an offset like "sunset - 30min" or "sunrise+1h".
+--
+-- @usage
+--      local sun = require("envel.sun"){latitude = 48.2, longitude = 16.37}
+--
+--      local elevation, azimuth = sun:position()
+--      print("sunset today at "..os.date("%H:%M", sun:times().sunset))
+--
+--      -- emits "sun::sunset-30min" every day 30 minutes before sunset
+--      sun:watch("sunset - 30min")
+--      sun:connect_signal("sun::sunset-30min", function() ... end)
+--
+--      -- schedules can be used for timers and rules.onSun
+--      timer{schedule = sun:schedule("sunrise"), callback = function() ... end}
+
+return require("envel.bindings.sun")
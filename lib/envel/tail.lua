@@ -0,0 +1,28 @@
+--- Module envel.tail follows files like `tail -F` without spawning a
+-- process. Rotation by renaming (e.g. logrotate) and truncation are
+-- detected and the new file is read from the beginning.
+--
+-- Reading starts at the end of the file. Set from_end to false to read the
+-- whole file or pass a previously saved offset to resume where envel stopped
+-- before. Within the line callback, t:offset() returns the position right
+-- after the current line.
+--
+-- The line callback is called with nil once the tail is stopped. All tails
+-- are stopped when envel exits.
+--
+-- @usage
+--      local t
+--      t = require("envel.tail"){
+--          path = "/var/log/messages",
+--          offset = store:get("messages_offset"),
+--          poll_interval = 0.5,
+--          line_callback = function(line)
+--              if line == nil then return end
+--              print(line)
+--              store:set("messages_offset", t:offset())
+--          end,
+--      }
+--
+--      t:stop()
+
+return _G.__core.tail
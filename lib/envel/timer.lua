@@ -32,12 +32,22 @@ function timer:is_started()
     return getmetatable(self).__timer:is_started()
 end
 
+-- Returns the time of the next tick as a unix timestamp or nil
+-- if the timer is not started
+function timer:next_run()
+    return getmetatable(self).__timer:next_run()
+end
+
 function timer:emit_signal(...)
     self.signal:emit_signal(unpack(arg))
 end
 
 function timer:connect_signal(...)
-    self.signal:connect_signal(unpack(arg))
+    return self.signal:connect_signal(unpack(arg))
+end
+
+function timer:connect_signal_once(...)
+    return self.signal:connect_signal_once(unpack(arg))
 end
 
 
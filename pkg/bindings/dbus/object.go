@@ -94,7 +94,7 @@ func objectCall(ud *lua.LUserData, method string, flags byte, fn *lua.LFunction,
 	call := obj.Go(method, dbus.Flags(flags), nil, args...)
 
 	l := loop.LGet(obj.L)
-	cb := callback.New(fn, l)
+	cb := callback.New(fn, l, callback.WithOrigin("dbus:"+method))
 
 	go func() {
 		<-call.Done
@@ -28,3 +28,18 @@ func getCommonMetricOpts(L *lua.LState, options *lua.LTable, opts *prometheus.Op
 		L.RaiseError("Metric name must be set")
 	}
 }
+
+// registerCollector registers c at the default prometheus registry. If an
+// equal collector has already been registered (e.g. because rc.lua has been
+// reloaded), the existing collector is returned instead
+func registerCollector(L *lua.LState, c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+
+		L.RaiseError(err.Error())
+	}
+
+	return c
+}
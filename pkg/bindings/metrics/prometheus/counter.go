@@ -32,7 +32,7 @@ func createNewCounter(L *lua.LState) int {
 
 	counter := prometheus.NewCounter(prometheus.CounterOpts(opts))
 
-	prometheus.MustRegister(counter)
+	counter = registerCollector(L, counter).(prometheus.Counter)
 
 	// prepare the actual user-data for the Lua VM
 	ud := L.NewUserData()
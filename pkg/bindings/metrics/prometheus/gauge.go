@@ -35,7 +35,7 @@ func createNewGauge(L *lua.LState) int {
 
 	gauge := prometheus.NewGauge(prometheus.GaugeOpts(opts))
 
-	prometheus.MustRegister(gauge)
+	gauge = registerCollector(L, gauge).(prometheus.Gauge)
 
 	// prepare the actual user-data for the Lua VM
 	ud := L.NewUserData()
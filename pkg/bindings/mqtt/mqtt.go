@@ -106,6 +106,12 @@ func newMQTT(L *lua.LState) int {
 		return 0
 	}
 
+	// disconnect once the loop is stopped so subscriptions
+	// do not outlive the VM
+	loop.LGet(L).OnExit(func(*lua.LState) {
+		mq.Disconnect(100)
+	})
+
 	ud := L.NewUserData()
 	ud.Value = mq
 	L.SetMetatable(ud, L.GetTypeMetatable(mqttTypeName))
@@ -115,6 +121,10 @@ func newMQTT(L *lua.LState) int {
 	return 1
 }
 
+// mqttSubscribe provides `mqtt:subscribe{topic = "...", qos = 0, callback = fn}`.
+// The delivery of messages can be configured using the fields `coalesce`
+// (only deliver the latest pending message per topic), `min_interval` (in
+// seconds) and `max_in_flight`
 func mqttSubscribe(L *lua.LState) int {
 	mq := checkMQTT(L)
 
@@ -139,13 +149,23 @@ func mqttSubscribe(L *lua.LState) int {
 		L.ArgError(1, "callback must be set to a function")
 	}
 
-	cb := callback.New(fn.(*lua.LFunction), loop.LGet(L))
+	delivery := callback.CheckDelivery(L, 1, opts)
+
+	cb := callback.New(fn.(*lua.LFunction), loop.LGet(L),
+		callback.WithOrigin("mqtt:"+topic.(lua.LString).String()),
+		callback.WithDelivery(delivery),
+	)
+
+	// without a delivery mode messages are delivered one after the other.
+	// Otherwise the delivery decides which messages are passed to the
+	// callback (e.g. only the latest message per topic)
+	wait := delivery == callback.Delivery{}
 
 	token := mq.Subscribe(
 		topic.(lua.LString).String(),
 		byte(qos.(lua.LNumber)),
 		func(cli mqtt.Client, msg mqtt.Message) {
-			<-cb.From(func(L *lua.LState) []lua.LValue {
+			h := cb.FromKey(msg.Topic(), func(L *lua.LState) []lua.LValue {
 				t := L.NewTable()
 				L.SetField(t, "body", lua.LString(msg.Payload()))
 				L.SetField(t, "topic", lua.LString(msg.Topic()))
@@ -153,6 +173,10 @@ func mqttSubscribe(L *lua.LState) int {
 
 				return []lua.LValue{t}
 			})
+
+			if wait {
+				h.Wait()
+			}
 		},
 	)
 	token.Wait()
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
 	tpshp "github.com/ppacher/tplink-smart-home-protocol"
 	lua "github.com/yuin/gopher-lua"
 )
@@ -56,17 +57,38 @@ func checkAPIClient(L *lua.LState, arg int) tpshp.Client {
 	return nil
 }
 
+// tpshpSend provides `api:send(message, cb)`. If cb is omitted a pending
+// operation is returned that can be used with await()
 func tpshpSend(L *lua.LState) int {
 	cli := checkAPIClient(L, 1)
 	message := L.CheckString(2)
-	cb := callback.LGet(3, L)
+	cb := callback.LGetOpt(3, L)
+
+	if cb == nil {
+		ud, p := loop.NewPending(L)
+
+		go func() {
+			response, err := cli.Send(context.Background(), []byte(message))
+			if err != nil {
+				p.Reject(err)
+				return
+			}
+
+			p.Resolve(func(L *lua.LState) []lua.LValue {
+				return []lua.LValue{lua.LString(response)}
+			})
+		}()
+
+		L.Push(ud)
+		return 1
+	}
 
 	go func() {
 		response, err := cli.Send(context.Background(), []byte(message))
 		if err != nil {
-			<-cb.Do(lua.LNil, lua.LString(err.Error()))
+			cb.Do(lua.LNil, lua.LString(err.Error())).Wait()
 		} else {
-			<-cb.Do(lua.LString(response))
+			cb.Do(lua.LString(response)).Wait()
 		}
 	}()
 
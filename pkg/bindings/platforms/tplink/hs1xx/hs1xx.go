@@ -177,13 +177,34 @@ func realtimeToTable(L *lua.LState, realtime *tpsmartapi.RealtimeInfo) *lua.LTab
 	return result
 }
 
+// hs1xxGetRealtime provides `hs1xx:realtime(cb)`. If cb is omitted a pending
+// operation is returned that can be used with await()
 func hs1xxGetRealtime(L *lua.LState) int {
 	hs := checkHS1xx(L, 1)
-	cb := callback.LGet(2, L)
+	cb := callback.LGetOpt(2, L)
+
+	if cb == nil {
+		ud, p := loop.NewPending(L)
+
+		go func() {
+			realtime := <-hs.EMeter().GetRealtime(context.Background())
+			if realtime.Err() != nil {
+				p.Reject(realtime.Err())
+				return
+			}
+
+			p.Resolve(func(L *lua.LState) []lua.LValue {
+				return []lua.LValue{realtimeToTable(L, realtime)}
+			})
+		}()
+
+		L.Push(ud)
+		return 1
+	}
 
 	go func() {
 		realtime := <-hs.EMeter().GetRealtime(context.Background())
-		<-cb.From(func(L *lua.LState) []lua.LValue {
+		cb.From(func(L *lua.LState) []lua.LValue {
 			if realtime.Err() != nil {
 				return []lua.LValue{
 					lua.LNil,
@@ -192,7 +213,7 @@ func hs1xxGetRealtime(L *lua.LState) int {
 			}
 
 			return []lua.LValue{realtimeToTable(L, realtime)}
-		})
+		}).Wait()
 	}()
 
 	return 0
@@ -269,6 +290,11 @@ func hs1xxWatchRelay(L *lua.LState) int {
 	return 1
 }
 
+// hs1xxWatchRealtime provides `hs1xx:watch_realtime(timeout, [opts])` and
+// emits a "realtime" signal with the current power consumption every timeout
+// seconds. opts may configure the delivery of the signal to each subscriber
+// using the fields `coalesce`, `min_interval` and `max_in_flight` (see
+// mqtt:subscribe)
 func hs1xxWatchRealtime(L *lua.LState) int {
 	hs := checkHS1xx(L, 1)
 	timeout := L.CheckNumber(2)
@@ -280,6 +306,10 @@ func hs1xxWatchRealtime(L *lua.LState) int {
 		return 0
 	}
 
+	if opts := L.OptTable(3, nil); opts != nil {
+		sig.SetDelivery("realtime", callback.CheckDelivery(L, 3, opts))
+	}
+
 	duration := time.Duration(float64(timeout) * float64(time.Second))
 
 	var timer *core.Timer
@@ -0,0 +1,338 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/loop"
+	"github.com/ppacher/envel/pkg/signal"
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+const namespaceTypeName = "store_namespace"
+
+// DefaultNamespace is used for methods called on the store object directly
+const DefaultNamespace = "default"
+
+var namespaceAPI = map[string]lua.LGFunction{
+	"get":       namespaceGet,
+	"set":       namespaceSet,
+	"delete":    namespaceDelete,
+	"keys":      namespaceKeys,
+	"namespace": storeNamespace,
+}
+
+// luaStore binds a store to a loop
+type luaStore struct {
+	*Store
+
+	loop   loop.Loop
+	signal *signal.Signal
+
+	lock   sync.Mutex
+	expiry map[string]loop.Handle
+}
+
+var (
+	openLock sync.Mutex
+	open     = make(map[string]*openStore)
+)
+
+// openStore is a store used by at least one loop
+type openStore struct {
+	*Store
+	refs int
+}
+
+// acquire returns the store at path. Stores are shared by all loops of
+// the process so the VM created when reloading the script does not read
+// the file while the current VM is still modifying it. See release
+func acquire(path string) (*Store, error) {
+	openLock.Lock()
+	defer openLock.Unlock()
+
+	if o, ok := open[path]; ok {
+		o.refs++
+		return o.Store, nil
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	open[path] = &openStore{Store: s, refs: 1}
+	return s, nil
+}
+
+// release releases a store returned by acquire. The store is opened from
+// the file again once it is no longer used by any loop
+func release(s *Store) {
+	openLock.Lock()
+	defer openLock.Unlock()
+
+	o, ok := open[s.Path()]
+	if !ok || o.Store != s {
+		return
+	}
+
+	o.refs--
+	if o.refs == 0 {
+		delete(open, s.Path())
+	}
+}
+
+// namespace is the value of namespace objects. The store object itself
+// uses the default namespace
+type namespace struct {
+	store *luaStore
+	name  string
+}
+
+// newStore provides `store{path = "..."}`. Stores are cached by path so
+// all scripts share the same instance. The underlying store is shared with
+// other loops (e.g. while reloading) and released once the loop exits
+func newStore(L *lua.LState) int {
+	mod := L.CheckTable(1)
+	opts := L.CheckTable(2)
+
+	path, ok := opts.RawGetString("path").(lua.LString)
+	if !ok {
+		L.ArgError(1, "path must be set to a string")
+		return 0
+	}
+
+	abs, err := filepath.Abs(string(path))
+	if err != nil {
+		L.RaiseError("store: %s", err.Error())
+		return 0
+	}
+
+	instances, ok := mod.RawGetString("__instances").(*lua.LTable)
+	if !ok {
+		instances = L.NewTable()
+		mod.RawSetString("__instances", instances)
+	}
+
+	if ud := instances.RawGetString(abs); ud != lua.LNil {
+		L.Push(ud)
+		return 1
+	}
+
+	s, err := acquire(abs)
+	if err != nil {
+		L.RaiseError("store: %s", err.Error())
+		return 0
+	}
+
+	ls := &luaStore{
+		Store:  s,
+		loop:   loop.LGet(L),
+		expiry: make(map[string]loop.Handle),
+	}
+
+	ud := L.NewUserData()
+	ud.Value = &namespace{store: ls, name: DefaultNamespace}
+
+	// each instance needs its own metatable so signals
+	// are not shared
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), namespaceAPI))
+	L.SetMetatable(ud, mt)
+
+	_, ls.signal = signal.Extend(L, ud)
+
+	// the store may be modified by other loops as well so expiry
+	// timers are armed for all changes
+	unsubscribe := s.OnChange(ls.changed)
+
+	ls.loop.OnExit(func(*lua.LState) {
+		unsubscribe()
+		release(s)
+	})
+
+	for name, ns := range s.Entries() {
+		for key, e := range ns {
+			ls.armExpiry(name, key, e)
+		}
+	}
+
+	instances.RawSetString(abs, ud)
+
+	L.Push(ud)
+	return 1
+}
+
+// changed arms the expiry of the current entry for key and emits the
+// change signals
+func (ls *luaStore) changed(ns, key string, value, old json.RawMessage) {
+	e, _ := ls.Get(ns, key)
+	ls.armExpiry(ns, key, e)
+
+	ls.emitChange(ns, key, value, old)
+}
+
+// emitChange emits store::changed and store::changed::<namespace>::<key>
+func (ls *luaStore) emitChange(ns, key string, value, old json.RawMessage) {
+	ls.signal.EmitFrom("store::changed", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{lua.LString(ns), lua.LString(key), decode(L, value), decode(L, old)}
+	})
+
+	ls.signal.EmitFrom(fmt.Sprintf("store::changed::%s::%s", ns, key), func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{decode(L, value), decode(L, old)}
+	})
+}
+
+// armExpiry removes the entry once its TTL elapsed so change signals
+// are emitted for expired keys as well
+func (ls *luaStore) armExpiry(ns, key string, e *Entry) {
+	id := ns + "\x00" + key
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	if h, ok := ls.expiry[id]; ok {
+		h.Cancel()
+		delete(ls.expiry, id)
+	}
+
+	if e == nil || e.Expires == nil {
+		return
+	}
+
+	var h loop.Handle
+	h = ls.loop.ScheduleAt(*e.Expires, func(L *lua.LState) {
+		ls.lock.Lock()
+		if ls.expiry[id] == h {
+			delete(ls.expiry, id)
+		}
+		ls.lock.Unlock()
+
+		if _, err := ls.Expire(ns, key, e); err != nil {
+			log.Printf("store: failed to expire %s/%s: %s\n", ns, key, err.Error())
+		}
+	})
+	ls.expiry[id] = h
+}
+
+func decode(L *lua.LState, value json.RawMessage) lua.LValue {
+	if value == nil {
+		return lua.LNil
+	}
+
+	v, err := luajson.Decode(L, value)
+	if err != nil {
+		return lua.LNil
+	}
+
+	return v
+}
+
+func checkNamespace(L *lua.LState) *namespace {
+	ud := L.CheckUserData(1)
+	if ns, ok := ud.Value.(*namespace); ok {
+		return ns
+	}
+
+	L.ArgError(1, "expected a store or namespace object")
+	return nil
+}
+
+// storeNamespace returns a namespace object for the name passed. Namespaces
+// provide the same get, set, delete and keys methods as the store
+func storeNamespace(L *lua.LState) int {
+	ns := checkNamespace(L)
+	name := L.CheckString(2)
+
+	ud := L.NewUserData()
+	ud.Value = &namespace{store: ns.store, name: name}
+	L.SetMetatable(ud, L.GetTypeMetatable(namespaceTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+// namespaceGet provides `store:get(key, [default])`. The default is returned
+// if the key does not exist or has expired
+func namespaceGet(L *lua.LState) int {
+	ns := checkNamespace(L)
+	key := L.CheckString(2)
+
+	e, ok := ns.store.Get(ns.name, key)
+	if !ok {
+		L.Push(L.Get(3))
+		return 1
+	}
+
+	v, err := luajson.Decode(L, e.Value)
+	if err != nil {
+		L.RaiseError("store: failed to decode %s: %s", key, err.Error())
+		return 0
+	}
+
+	L.Push(v)
+	return 1
+}
+
+// namespaceSet provides `store:set(key, value, [ttl])`. The value must be
+// JSON serializable. If ttl (in seconds) is set the key expires afterwards.
+// Setting a key to nil deletes it
+func namespaceSet(L *lua.LState) int {
+	ns := checkNamespace(L)
+	key := L.CheckString(2)
+	value := L.Get(3)
+	ttl := time.Duration(float64(L.OptNumber(4, 0)) * float64(time.Second))
+
+	if value == lua.LNil {
+		if _, err := ns.store.Delete(ns.name, key); err != nil {
+			L.RaiseError("store: %s", err.Error())
+		}
+		return 0
+	}
+
+	blob, err := luajson.Encode(value)
+	if err != nil {
+		L.ArgError(3, fmt.Sprintf("value must be JSON serializable: %s", err.Error()))
+		return 0
+	}
+
+	if _, err := ns.store.Set(ns.name, key, blob, ttl); err != nil {
+		L.RaiseError("store: %s", err.Error())
+	}
+
+	return 0
+}
+
+// namespaceDelete provides `store:delete(key)` and returns true if the key
+// existed
+func namespaceDelete(L *lua.LState) int {
+	ns := checkNamespace(L)
+	key := L.CheckString(2)
+
+	ok, err := ns.store.Delete(ns.name, key)
+	if err != nil {
+		L.RaiseError("store: %s", err.Error())
+		return 0
+	}
+
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+// namespaceKeys returns a sorted list of all keys
+func namespaceKeys(L *lua.LState) int {
+	ns := checkNamespace(L)
+
+	keys := L.NewTable()
+	for _, key := range ns.store.Keys(ns.name) {
+		keys.Append(lua.LString(key))
+	}
+
+	L.Push(keys)
+	return 1
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Preload preloads the envel.bindings.store package
+func Preload(L *lua.LState) {
+	L.PreloadModule("envel.bindings.store", Loader)
+}
+
+// Loader loads the actual store package
+func Loader(L *lua.LState) int {
+	t := L.NewTable()
+
+	namespaceMt := L.NewTypeMetatable(namespaceTypeName)
+	L.SetField(namespaceMt, "__index", L.SetFuncs(L.NewTable(), namespaceAPI))
+	L.SetField(t, "__namespace_mt", namespaceMt)
+
+	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newStore,
+	}))
+
+	L.Push(t)
+	return 1
+}
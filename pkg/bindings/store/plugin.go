@@ -0,0 +1,25 @@
+//go:generate go run ../../../hacks/build-plugin.go -o ../../../plugins/ github.com/ppacher/envel/pkg/bindings/store
+
+package store
+
+import (
+	"github.com/ppacher/envel/pkg/plugin"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Binding implements plugin.Binding
+type Binding struct{}
+
+// Preload preloads the store module
+func (Binding) Preload(L *lua.LState) error {
+	Preload(L)
+	return nil
+}
+
+var Plugin = plugin.New(
+	plugin.WithBinding(Binding{}),
+)
+
+func init() {
+	plugin.Register("store", Plugin)
+}
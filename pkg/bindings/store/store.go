@@ -0,0 +1,266 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/core"
+)
+
+// Entry is a single value stored in a namespace
+type Entry struct {
+	// Value holds the JSON encoded value
+	Value json.RawMessage `json:"value"`
+
+	// Expires is set if the entry has a TTL
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Expired returns true if the entry has a TTL that elapsed before now
+func (e *Entry) Expired(now time.Time) bool {
+	return e.Expires != nil && !e.Expires.After(now)
+}
+
+// ChangeFunc is called whenever a key is set, deleted or expires. old and
+// value are nil if the key did not exist before or has been removed
+type ChangeFunc func(namespace, key string, value, old json.RawMessage)
+
+// Store is a durable key-value store with namespaces. All modifications
+// are written to a local file immediately
+type Store struct {
+	path string
+
+	lock       sync.Mutex
+	namespaces map[string]map[string]*Entry
+	onChange   []*ChangeFunc
+}
+
+// Open opens the store at path. The file is created on the first
+// write if it does not exist. Expired entries are removed
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:       path,
+		namespaces: make(map[string]map[string]*Entry),
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(blob, &s.namespaces); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	now := time.Now()
+	for _, ns := range s.namespaces {
+		for key, e := range ns {
+			if e.Expired(now) {
+				delete(ns, key)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Path returns the path of the store file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// OnChange registers fn to be called for each modification. The returned
+// function removes fn again
+func (s *Store) OnChange(fn ChangeFunc) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	handler := &fn
+	s.onChange = append(s.onChange, handler)
+
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		for i, h := range s.onChange {
+			if h == handler {
+				s.onChange = append(s.onChange[:i:i], s.onChange[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Get returns the entry for key in namespace. Expired entries are not
+// returned
+func (s *Store) Get(namespace, key string) (*Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.namespaces[namespace][key]
+	if !ok || e.Expired(time.Now()) {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// Set stores value for key in namespace and returns the new entry. If ttl
+// is greater than zero the entry expires after ttl
+func (s *Store) Set(namespace, key string, value json.RawMessage, ttl time.Duration) (*Entry, error) {
+	e := &Entry{Value: value}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		e.Expires = &expires
+	}
+
+	s.lock.Lock()
+	ns, ok := s.namespaces[namespace]
+	if !ok {
+		ns = make(map[string]*Entry)
+		s.namespaces[namespace] = ns
+	}
+
+	var old json.RawMessage
+	prev, existed := ns[key]
+	if existed && !prev.Expired(time.Now()) {
+		old = prev.Value
+	}
+
+	ns[key] = e
+	err := s.saveLocked()
+	if err != nil {
+		// keep the entries in sync with the file
+		if existed {
+			ns[key] = prev
+		} else {
+			s.deleteLocked(namespace, key)
+		}
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.notify(namespace, key, value, old)
+	return e, nil
+}
+
+// Delete removes key from namespace. It returns false if the key did
+// not exist
+func (s *Store) Delete(namespace, key string) (bool, error) {
+	return s.remove(namespace, key, nil)
+}
+
+// Expire removes e from namespace if it is still the current entry for
+// key and has expired
+func (s *Store) Expire(namespace, key string, e *Entry) (bool, error) {
+	return s.remove(namespace, key, e)
+}
+
+func (s *Store) remove(namespace, key string, expected *Entry) (bool, error) {
+	s.lock.Lock()
+	ns := s.namespaces[namespace]
+
+	e, ok := ns[key]
+	if !ok || (expected != nil && (e != expected || !e.Expired(time.Now()))) {
+		s.lock.Unlock()
+		return false, nil
+	}
+
+	s.deleteLocked(namespace, key)
+
+	err := s.saveLocked()
+	if err != nil {
+		// keep the entries in sync with the file
+		ns[key] = e
+		s.namespaces[namespace] = ns
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	if expected == nil && e.Expired(time.Now()) {
+		// the value has already been gone for the user
+		return false, nil
+	}
+
+	s.notify(namespace, key, nil, e.Value)
+	return true, nil
+}
+
+// Keys returns all keys of namespace that have not expired, sorted
+// alphabetically
+func (s *Store) Keys(namespace string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(s.namespaces[namespace]))
+	for key, e := range s.namespaces[namespace] {
+		if !e.Expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Entries returns all entries of all namespaces including ones that have
+// already expired
+func (s *Store) Entries() map[string]map[string]*Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make(map[string]map[string]*Entry, len(s.namespaces))
+	for name, ns := range s.namespaces {
+		res[name] = make(map[string]*Entry, len(ns))
+		for key, e := range ns {
+			res[name][key] = e
+		}
+	}
+
+	return res
+}
+
+// deleteLocked removes key from namespace and the namespace itself
+// once it is empty
+func (s *Store) deleteLocked(namespace, key string) {
+	ns := s.namespaces[namespace]
+
+	delete(ns, key)
+	if len(ns) == 0 {
+		delete(s.namespaces, namespace)
+	}
+}
+
+func (s *Store) saveLocked() error {
+	blob, err := json.MarshalIndent(s.namespaces, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return core.WriteFileAtomic(s.path, blob, 0600)
+}
+
+func (s *Store) notify(namespace, key string, value, old json.RawMessage) {
+	s.lock.Lock()
+	handlers := s.onChange
+	s.lock.Unlock()
+
+	for _, fn := range handlers {
+		(*fn)(namespace, key, value, old)
+	}
+}
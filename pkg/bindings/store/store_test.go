@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ppacher/envel/pkg/loop"
+	signalBinding "github.com/ppacher/envel/pkg/signal"
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func tempStorePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "envel-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "state.json"), func() { os.RemoveAll(dir) }
+}
+
+func Test_Store(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []string
+	s.OnChange(func(ns, key string, value, old json.RawMessage) {
+		changes = append(changes, ns+"/"+key+"="+string(value))
+	})
+
+	s.Set("laundry", "was_running", json.RawMessage(`true`), 0)
+	s.Set("laundry", "door", json.RawMessage(`"open"`), time.Millisecond)
+	s.Set("energy", "total", json.RawMessage(`12.5`), 0)
+
+	if ok, _ := s.Delete("energy", "total"); !ok {
+		t.Errorf("expected energy/total to be deleted")
+	}
+
+	if ok, _ := s.Delete("energy", "total"); ok {
+		t.Errorf("expected a second delete to return false")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := s.Get("laundry", "door"); ok {
+		t.Errorf("expected laundry/door to be expired")
+	}
+
+	if len(changes) != 4 {
+		t.Errorf("expected 4 changes but got %v", changes)
+	}
+
+	// re-open the store and make sure only laundry/was_running survived
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := s.Get("laundry", "was_running")
+	if !ok || string(e.Value) != "true" {
+		t.Errorf("expected laundry/was_running to be restored")
+	}
+
+	if keys := s.Keys("laundry"); len(keys) != 1 {
+		t.Errorf("expected one key but got %v", keys)
+	}
+
+	if keys := s.Keys("energy"); len(keys) != 0 {
+		t.Errorf("expected no keys but got %v", keys)
+	}
+}
+
+func Test_StoreWriteError(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Set("laundry", "door", json.RawMessage(`"open"`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// writing the file fails once its directory is gone
+	cleanup()
+
+	if _, err := s.Set("laundry", "door", json.RawMessage(`"closed"`), 0); err == nil {
+		t.Errorf("expected setting laundry/door to fail")
+	}
+
+	if _, err := s.Set("energy", "total", json.RawMessage(`12.5`), 0); err == nil {
+		t.Errorf("expected setting energy/total to fail")
+	}
+
+	if _, err := s.Delete("laundry", "door"); err == nil {
+		t.Errorf("expected deleting laundry/door to fail")
+	}
+
+	// failed modifications must not be visible
+	if e, ok := s.Get("laundry", "door"); !ok || string(e.Value) != `"open"` {
+		t.Errorf("expected laundry/door to still be open but got %v", e)
+	}
+
+	if _, ok := s.Get("energy", "total"); ok {
+		t.Errorf("expected energy/total to not exist")
+	}
+
+	if entries := s.Entries(); len(entries) != 1 {
+		t.Errorf("expected one namespace but got %v", entries)
+	}
+}
+
+func Test_StoreLua(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	l, done := helper.GetTestLoop(t, signalBinding.OpenSignal, Preload)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("path", lua.LString(path))
+
+		err := L.DoString(`
+		local store = require("envel.bindings.store")
+		local s = store{path = path}
+
+		assert(store{path = path} == s, "expected stores to be cached by path")
+
+		local notified = false
+		s:connect_signal("store::changed", function(ns, key, value)
+			if ns == "laundry" and key == "door" and value == nil then
+				notified = true
+			end
+		end)
+
+		s:connect_signal("store::changed::laundry::door", function(value, old)
+			if value == nil and old == "open" then
+				assert(notified)
+				done()
+			end
+		end)
+
+		local laundry = s:namespace("laundry")
+		laundry:set("was_running", true)
+		laundry:set("cycles", {count = 3, names = {"eco", "quick"}})
+		laundry:set("door", "open", 0.01)
+
+		assert(laundry:get("was_running") == true)
+		assert(laundry:get("cycles").names[2] == "quick")
+		assert(laundry:get("missing", "default") == "default")
+		assert(#laundry:keys() == 3)
+
+		s:set("key", "value")
+		assert(s:get("key") == "value")
+		assert(s:delete("key"))
+		assert(s:get("key") == nil)
+
+		local ok = pcall(function() s:set("fn", function() end) end)
+		assert(not ok, "expected functions to be rejected")
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("key did not expire")
+	}
+
+	l.Stop()
+	l.Wait()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := s.Keys("laundry"); len(keys) != 2 {
+		t.Errorf("expected 2 keys but got %v", keys)
+	}
+}
+
+func Test_StoreSharedByLoops(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	// while reloading, the current and the new loop use the same store
+	current, _ := helper.GetTestLoop(t, signalBinding.OpenSignal, Preload)
+	next, _ := helper.GetTestLoop(t, signalBinding.OpenSignal, Preload)
+
+	open := func(l loop.Loop, script string) {
+		l.ScheduleAndWait(func(L *lua.LState) {
+			L.SetGlobal("path", lua.LString(path))
+			if err := L.DoString(`s = require("envel.bindings.store"){path = path}` + "\n" + script); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	open(current, "")
+	open(next, `s:set("next", true)`)
+	open(current, `
+	assert(s:get("next") == true, "expected the update of the new loop")
+	s:set("current", true)
+	`)
+
+	current.Stop()
+	current.Wait()
+
+	open(next, `assert(s:get("current") == true, "expected the update of the current loop")`)
+
+	next.Stop()
+	next.Wait()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := s.Keys(DefaultNamespace); len(keys) != 2 {
+		t.Errorf("expected both updates to be persisted but got %v", keys)
+	}
+}
@@ -0,0 +1,172 @@
+package sun
+
+import (
+	"math"
+	"time"
+)
+
+// Event is a named point in time of the daily course of the sun
+type Event string
+
+// All events supported. Dawn and dusk events are reached when the center of
+// the sun crosses the respective elevation angle below the horizon
+const (
+	AstronomicalDawn Event = "astronomical_dawn"
+	NauticalDawn     Event = "nautical_dawn"
+	CivilDawn        Event = "civil_dawn"
+	Sunrise          Event = "sunrise"
+	Noon             Event = "noon"
+	Sunset           Event = "sunset"
+	CivilDusk        Event = "civil_dusk"
+	NauticalDusk     Event = "nautical_dusk"
+	AstronomicalDusk Event = "astronomical_dusk"
+)
+
+// Events holds all events in the order they occur during a day
+var Events = []Event{
+	AstronomicalDawn,
+	NauticalDawn,
+	CivilDawn,
+	Sunrise,
+	Noon,
+	Sunset,
+	CivilDusk,
+	NauticalDusk,
+	AstronomicalDusk,
+}
+
+// eventAliases holds alternative names for events
+var eventAliases = map[string]Event{
+	"dawn": CivilDawn,
+	"dusk": CivilDusk,
+}
+
+// eventAngles holds the solar elevation angle for each event and whether
+// the event happens before (rising) or after noon
+var eventAngles = map[Event]struct {
+	angle  float64
+	rising bool
+}{
+	AstronomicalDawn: {-18, true},
+	NauticalDawn:     {-12, true},
+	CivilDawn:        {-6, true},
+	Sunrise:          {-0.833, true},
+	Sunset:           {-0.833, false},
+	CivilDusk:        {-6, false},
+	NauticalDusk:     {-12, false},
+	AstronomicalDusk: {-18, false},
+}
+
+const (
+	rad = math.Pi / 180
+
+	// j2000 is the julian date of 2000-01-01 12:00 UTC
+	j2000 = 2451545.0
+
+	// obliquity of the earth
+	obliquity = 23.4397 * rad
+)
+
+func toJulian(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(0, int64((j-2440587.5)*float64(24*time.Hour))).UTC()
+}
+
+// solarMeanAnomaly returns the mean anomaly for d days since J2000
+func solarMeanAnomaly(d float64) float64 {
+	return rad * (357.5291 + 0.98560028*d)
+}
+
+// eclipticLongitude returns the ecliptic longitude for the mean anomaly m
+func eclipticLongitude(m float64) float64 {
+	c := rad * (1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m))
+	perihelion := rad * 102.9372
+
+	return m + c + perihelion + math.Pi
+}
+
+func declination(l float64) float64 {
+	return math.Asin(math.Sin(l) * math.Sin(obliquity))
+}
+
+func rightAscension(l float64) float64 {
+	return math.Atan2(math.Sin(l)*math.Cos(obliquity), math.Cos(l))
+}
+
+// Position returns the elevation and the azimuth of the sun in degrees at t for
+// the given location. The azimuth is measured clockwise from north
+func Position(t time.Time, latitude, longitude float64) (elevation, azimuth float64) {
+	d := toJulian(t) - j2000
+	phi := rad * latitude
+
+	m := solarMeanAnomaly(d)
+	l := eclipticLongitude(m)
+	dec := declination(l)
+	ra := rightAscension(l)
+
+	sidereal := rad*(280.16+360.9856235*d) + rad*longitude
+	h := sidereal - ra
+
+	elevation = math.Asin(math.Sin(phi)*math.Sin(dec) + math.Cos(phi)*math.Cos(dec)*math.Cos(h))
+	azimuth = math.Atan2(math.Sin(h), math.Cos(h)*math.Sin(phi)-math.Tan(dec)*math.Cos(phi))
+
+	azimuth = math.Mod(azimuth/rad+180, 360)
+	if azimuth < 0 {
+		azimuth += 360
+	}
+
+	return elevation / rad, azimuth
+}
+
+// EventTime returns the time of event for the solar day closest to date at
+// the given location. It returns false if the event does not happen on that
+// day (e.g. during polar day or night)
+func EventTime(event Event, date time.Time, latitude, longitude float64) (time.Time, bool) {
+	// days since J2000 of the solar transit closest to date
+	n := math.Round(toJulian(date) - j2000 - 0.0009 + longitude/360)
+	ds := 0.0009 - longitude/360 + n
+
+	m := solarMeanAnomaly(ds)
+	l := eclipticLongitude(m)
+	dec := declination(l)
+
+	transit := j2000 + ds + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*l)
+
+	if event == Noon {
+		return fromJulian(transit), true
+	}
+
+	a, ok := eventAngles[event]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	phi := rad * latitude
+	cosW := (math.Sin(a.angle*rad) - math.Sin(phi)*math.Sin(dec)) / (math.Cos(phi) * math.Cos(dec))
+	if cosW < -1 || cosW > 1 {
+		return time.Time{}, false
+	}
+
+	w := math.Acos(cosW) / (2 * math.Pi)
+	if a.rising {
+		return fromJulian(transit - w), true
+	}
+
+	return fromJulian(transit + w), true
+}
+
+// Times returns all events that happen during the solar day closest to date
+func Times(date time.Time, latitude, longitude float64) map[Event]time.Time {
+	res := make(map[Event]time.Time, len(Events))
+
+	for _, e := range Events {
+		if t, ok := EventTime(e, date, latitude, longitude); ok {
+			res[e] = t
+		}
+	}
+
+	return res
+}
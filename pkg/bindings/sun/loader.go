@@ -0,0 +1,32 @@
+package sun
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Preload preloads the envel.bindings.sun package
+func Preload(L *lua.LState) {
+	L.PreloadModule("envel.bindings.sun", Loader)
+}
+
+// Loader loads the actual sun package
+func Loader(L *lua.LState) int {
+	t := L.NewTable()
+
+	scheduleMt := L.NewTypeMetatable(scheduleTypeName)
+	L.SetField(scheduleMt, "__index", L.SetFuncs(L.NewTable(), scheduleTypeAPI))
+	L.SetField(t, "__schedule_mt", scheduleMt)
+
+	events := L.NewTable()
+	for _, e := range Events {
+		events.Append(lua.LString(e))
+	}
+	L.SetField(t, "events", events)
+
+	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newSun,
+	}))
+
+	L.Push(t)
+	return 1
+}
@@ -0,0 +1,86 @@
+package sun
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule fires at a sun event with an optional offset and implements
+// core.Schedule so it can be used with timers
+type Schedule struct {
+	Event     Event
+	Offset    time.Duration
+	Latitude  float64
+	Longitude float64
+}
+
+// Next returns the first time the schedule fires after t. It returns a zero
+// time if the event does not happen within the next year (e.g. sunset near
+// the poles)
+func (s *Schedule) Next(t time.Time) time.Time {
+	// start one day earlier as a negative offset may move
+	// tomorrows event to today
+	for day := -1; day <= 366; day++ {
+		date := t.Add(time.Duration(day) * 24 * time.Hour)
+
+		at, ok := EventTime(s.Event, date, s.Latitude, s.Longitude)
+		if !ok {
+			continue
+		}
+
+		at = at.Add(s.Offset)
+		if at.After(t) {
+			return at
+		}
+	}
+
+	return time.Time{}
+}
+
+// ParseEvent returns the event with the given name
+func ParseEvent(name string) (Event, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if e, ok := eventAliases[name]; ok {
+		return e, nil
+	}
+
+	for _, e := range Events {
+		if string(e) == name {
+			return e, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown sun event %q", name)
+}
+
+// ParseSpec parses an event specification like "sunset", "sunset - 30min" or
+// "sunrise+1h15m". Offsets use the format of time.ParseDuration but also
+// accept "min" as a unit
+func ParseSpec(spec string) (Event, time.Duration, error) {
+	idx := strings.IndexAny(spec, "+-")
+	if idx < 0 {
+		e, err := ParseEvent(spec)
+		return e, 0, err
+	}
+
+	e, err := ParseEvent(spec[:idx])
+	if err != nil {
+		return "", 0, err
+	}
+
+	value := strings.Replace(spec[idx+1:], " ", "", -1)
+	value = strings.Replace(value, "min", "m", -1)
+
+	offset, err := time.ParseDuration(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid offset in %q: %s", spec, err)
+	}
+
+	if spec[idx] == '-' {
+		offset = -offset
+	}
+
+	return e, offset, nil
+}
@@ -0,0 +1,201 @@
+package sun
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/core"
+	"github.com/ppacher/envel/pkg/loop"
+	"github.com/ppacher/envel/pkg/signal"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const scheduleTypeName = "sun_schedule"
+
+var sunAPI = map[string]lua.LGFunction{
+	"times":    sunTimes,
+	"position": sunPosition,
+	"schedule": sunSchedule,
+	"watch":    sunWatch,
+}
+
+var scheduleTypeAPI = map[string]lua.LGFunction{
+	"next": scheduleNext,
+}
+
+// Sun calculates sun events for a fixed location
+type Sun struct {
+	Latitude  float64
+	Longitude float64
+
+	signal *signal.Signal
+}
+
+// newSun creates a new sun object for the location passed in the options
+// table. The object is extended with signal methods
+func newSun(L *lua.LState) int {
+	opts := L.CheckTable(2)
+
+	s := &Sun{}
+
+	if v, ok := opts.RawGetString("latitude").(lua.LNumber); ok && v >= -90 && v <= 90 {
+		s.Latitude = float64(v)
+	} else {
+		L.ArgError(1, "latitude must be set to a number between -90 and 90")
+	}
+
+	if v, ok := opts.RawGetString("longitude").(lua.LNumber); ok && v >= -180 && v <= 180 {
+		s.Longitude = float64(v)
+	} else {
+		L.ArgError(1, "longitude must be set to a number between -180 and 180")
+	}
+
+	ud := L.NewUserData()
+	ud.Value = s
+
+	// each instance needs its own metatable so signals
+	// are not shared
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), sunAPI))
+	L.SetMetatable(ud, mt)
+
+	_, s.signal = signal.Extend(L, ud)
+
+	L.Push(ud)
+	return 1
+}
+
+func checkSun(L *lua.LState) *Sun {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*Sun); ok {
+		return s
+	}
+
+	L.ArgError(1, "expected a sun object")
+	return nil
+}
+
+// optTime returns the unix timestamp at stack index n as a time.Time
+// or the current time if the argument is nil
+func optTime(L *lua.LState, n int) time.Time {
+	if L.Get(n) == lua.LNil {
+		return time.Now()
+	}
+
+	ts := float64(L.CheckNumber(n))
+	return time.Unix(0, int64(ts*float64(time.Second)))
+}
+
+func toTimestamp(t time.Time) lua.LNumber {
+	return lua.LNumber(float64(t.UnixNano()) / float64(time.Second))
+}
+
+// sunTimes returns a table with the unix timestamps of all events during
+// the solar day closest to the timestamp passed (defaults to now). Events
+// that do not happen on that day are missing
+func sunTimes(L *lua.LState) int {
+	s := checkSun(L)
+	date := optTime(L, 2)
+
+	t := L.NewTable()
+	for e, at := range Times(date, s.Latitude, s.Longitude) {
+		t.RawSetString(string(e), toTimestamp(at))
+	}
+
+	L.Push(t)
+	return 1
+}
+
+// sunPosition returns the elevation and the azimuth of the sun in degrees
+// at the timestamp passed (defaults to now)
+func sunPosition(L *lua.LState) int {
+	s := checkSun(L)
+	at := optTime(L, 2)
+
+	elevation, azimuth := Position(at, s.Latitude, s.Longitude)
+
+	L.Push(lua.LNumber(elevation))
+	L.Push(lua.LNumber(azimuth))
+	return 2
+}
+
+// checkSchedule parses the event specification at stack index n
+func (s *Sun) checkSchedule(L *lua.LState, n int) *Schedule {
+	event, offset, err := ParseSpec(L.CheckString(n))
+	if err != nil {
+		L.ArgError(n, err.Error())
+		return nil
+	}
+
+	return &Schedule{
+		Event:     event,
+		Offset:    offset,
+		Latitude:  s.Latitude,
+		Longitude: s.Longitude,
+	}
+}
+
+// sunSchedule returns a schedule for an event specification like
+// "sunset - 30min". The schedule can be passed to timers as the
+// `schedule` option
+func sunSchedule(L *lua.LState) int {
+	s := checkSun(L)
+	sched := s.checkSchedule(L, 2)
+
+	ud := L.NewUserData()
+	ud.Value = sched
+	L.SetMetatable(ud, L.GetTypeMetatable(scheduleTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+// sunWatch starts a timer that emits a signal each time the event
+// specification passed is reached. The signal is named after the
+// specification without spaces (e.g. "sun::sunset-30min"). The
+// timer is returned
+func sunWatch(L *lua.LState) int {
+	s := checkSun(L)
+	sched := s.checkSchedule(L, 2)
+	name := "sun::" + strings.Replace(L.CheckString(2), " ", "", -1)
+
+	emit := L.NewFunction(func(L *lua.LState) int {
+		s.signal.Emit(name, toTimestamp(time.Now()))
+		return 0
+	})
+
+	ud, timer := core.NewTimer(L, core.TimerOptions{
+		Schedule:  sched,
+		Autostart: true,
+		Origin:    name,
+		Callback:  callback.New(emit, loop.LGet(L)),
+	})
+
+	if err := timer.Init(L); err != nil {
+		L.RaiseError(err.Error())
+	}
+
+	L.Push(ud)
+	return 1
+}
+
+// scheduleNext returns the unix timestamp of the next time the schedule
+// fires after the timestamp passed (defaults to now) or nil
+func scheduleNext(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	sched, ok := ud.Value.(*Schedule)
+	if !ok {
+		L.ArgError(1, "expected a sun schedule")
+		return 0
+	}
+
+	next := sched.Next(optTime(L, 2))
+	if next.IsZero() {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	L.Push(toTimestamp(next))
+	return 1
+}
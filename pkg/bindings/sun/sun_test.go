@@ -0,0 +1,146 @@
+package sun
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ppacher/envel/pkg/core"
+	signalBinding "github.com/ppacher/envel/pkg/signal"
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func assertTime(t *testing.T, name string, got time.Time, expected string) {
+	e, _ := time.Parse(time.RFC3339, expected)
+	if d := got.Sub(e); d > 3*time.Minute || d < -3*time.Minute {
+		t.Errorf("%s: expected %s but got %s", name, e, got)
+	}
+}
+
+func Test_EventTimes(t *testing.T) {
+	// New York, winter solstice
+	times := Times(time.Date(2026, 12, 21, 12, 0, 0, 0, time.UTC), 40.7128, -74.006)
+
+	assertTime(t, "sunrise", times[Sunrise], "2026-12-21T12:17:00Z")
+	assertTime(t, "sunset", times[Sunset], "2026-12-21T21:32:00Z")
+	assertTime(t, "noon", times[Noon], "2026-12-21T16:55:00Z")
+
+	// Vienna, summer solstice
+	times = Times(time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC), 48.2082, 16.3738)
+
+	assertTime(t, "sunrise", times[Sunrise], "2026-06-21T02:54:00Z")
+	assertTime(t, "sunset", times[Sunset], "2026-06-21T18:58:00Z")
+
+	for i := 1; i < len(Events); i++ {
+		if !times[Events[i]].After(times[Events[i-1]]) {
+			t.Errorf("expected %s to be after %s", Events[i], Events[i-1])
+		}
+	}
+
+	// midnight sun in Tromsø
+	times = Times(time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC), 69.65, 18.96)
+	if _, ok := times[Sunset]; ok {
+		t.Errorf("expected no sunset during polar day")
+	}
+}
+
+func Test_Position(t *testing.T) {
+	elevation, azimuth := Position(time.Date(2026, 6, 21, 10, 57, 0, 0, time.UTC), 48.2082, 16.3738)
+
+	// the maximum elevation is 90 - latitude + axial tilt
+	if math.Abs(elevation-65.2) > 0.5 {
+		t.Errorf("expected elevation to be ~65.2 but got %f", elevation)
+	}
+
+	if math.Abs(azimuth-180) > 2 {
+		t.Errorf("expected azimuth to be ~180 but got %f", azimuth)
+	}
+}
+
+func Test_ParseSpec(t *testing.T) {
+	cases := []struct {
+		spec   string
+		event  Event
+		offset time.Duration
+	}{
+		{"sunset", Sunset, 0},
+		{"sunset - 30min", Sunset, -30 * time.Minute},
+		{"sunrise+1h15m", Sunrise, 75 * time.Minute},
+		{"dusk", CivilDusk, 0},
+		{" nautical_dawn + 10m ", NauticalDawn, 10 * time.Minute},
+	}
+
+	for _, c := range cases {
+		e, offset, err := ParseSpec(c.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", c.spec, err)
+			continue
+		}
+
+		if e != c.event || offset != c.offset {
+			t.Errorf("%q: expected %s%s but got %s%s", c.spec, c.event, c.offset, e, offset)
+		}
+	}
+
+	for _, spec := range []string{"", "moonrise", "sunset - soon"} {
+		if _, _, err := ParseSpec(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func Test_ScheduleNext(t *testing.T) {
+	s := &Schedule{
+		Event:     Sunset,
+		Offset:    -30 * time.Minute,
+		Latitude:  48.2082,
+		Longitude: 16.3738,
+	}
+
+	// after todays sunset the next one is tomorrow
+	next := s.Next(time.Date(2026, 6, 21, 20, 0, 0, 0, time.UTC))
+	assertTime(t, "next", next, "2026-06-22T18:29:00Z")
+
+	// before sunset - 30min it's still today
+	next = s.Next(time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC))
+	assertTime(t, "next", next, "2026-06-21T18:29:00Z")
+}
+
+func Test_SunLua(t *testing.T) {
+	l, _ := helper.GetTestLoop(t, core.OpenCore, signalBinding.OpenSignal, Preload)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local sun = require("envel.bindings.sun"){latitude = 48.2082, longitude = 16.3738}
+
+		local ts = os.time{year = 2026, month = 6, day = 21, hour = 12}
+		local times = sun:times(ts)
+		assert(times.sunrise < times.noon and times.noon < times.sunset)
+
+		local elevation, azimuth = sun:position(times.noon)
+		assert(elevation > 60 and azimuth > 170 and azimuth < 190)
+
+		local sched = sun:schedule("sunset - 30min")
+		assert(math.abs(sched:next(ts) - (times.sunset - 1800)) < 1)
+
+		local t = _G.__core.timer{schedule = sched, callback = function() end}
+		t:start()
+		assert(t:next_run() ~= nil)
+		t:stop()
+
+		local w = sun:watch("sunrise")
+		assert(w:is_started())
+		w:stop()
+
+		sun:connect_signal("sun::sunrise", function() end)
+		assert(sun:subscribers("sun::sunrise") == 1)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
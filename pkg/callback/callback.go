@@ -1,7 +1,8 @@
 package callback
 
 import (
-	"log"
+	"context"
+	"fmt"
 
 	"github.com/ppacher/envel/pkg/loop"
 	lua "github.com/yuin/gopher-lua"
@@ -9,13 +10,34 @@ import (
 
 // Callback represents a lua callback that can be scheduled on the event loop
 type Callback interface {
-	// Do schedules the callback
-	Do(args ...lua.LValue) <-chan error
+	// Do schedules the callback. The returned handle can be used to cancel
+	// the invocation or to wait for it. Its error is set to the Lua error
+	// returned by the callback
+	Do(args ...lua.LValue) loop.Handle
 
 	// From schedules the callback to be executed on the loop
 	// The passed function is executed just before the callback and can
 	// be used to construct lua objects
-	From(func(*lua.LState) []lua.LValue) <-chan error
+	From(func(*lua.LState) []lua.LValue) loop.Handle
+
+	// DoKey works like Do but identifies the invocation by key. If the
+	// callback coalesces invocations (see WithDelivery) or the loop uses
+	// loop.PolicyCoalesce and its queue is full, a pending invocation
+	// with the same key is replaced
+	DoKey(key string, args ...lua.LValue) loop.Handle
+
+	// FromKey works like From but identifies the invocation by key. See DoKey
+	FromKey(key string, fn func(*lua.LState) []lua.LValue) loop.Handle
+
+	// Call invokes the callback and returns its results. See FromWithResult
+	Call(ctx context.Context, L *lua.LState, args ...lua.LValue) (*Results, error)
+
+	// FromWithResult invokes the callback with the arguments returned by the
+	// passed function and waits for the results. Callers that already execute
+	// on the loop should pass their LState. The callback is then invoked
+	// directly instead of waiting for the loop. The invocation is interrupted
+	// once the deadline of ctx is exceeded
+	FromWithResult(ctx context.Context, L *lua.LState, fn func(*lua.LState) []lua.LValue) (*Results, error)
 
 	// Callable returns the callbacks callable. Use with care
 	Callable() *lua.LFunction
@@ -33,29 +55,83 @@ type Callback interface {
 type callback struct {
 	callable *lua.LFunction
 	loop     loop.Loop
+	priority loop.Priority
+	origin   string
+	delivery *delivery
+
+	// key identifies invocations of the callback on the loop so
+	// loop.PolicyCoalesce replaces the latest one once the queue is full
+	key string
+}
+
+// Option configures a callback
+type Option func(*callback)
+
+// WithPriority schedules all invocations of the callback in the
+// loop lane for priority
+func WithPriority(priority loop.Priority) Option {
+	return func(cb *callback) {
+		cb.priority = priority
+	}
+}
+
+// WithOrigin annotates errors returned by the callback with the binding
+// that invoked it (e.g. "mqtt:home/+/status" or "signal:timer::tick")
+func WithOrigin(origin string) Option {
+	return func(cb *callback) {
+		cb.origin = origin
+	}
 }
 
 // New returns a new callback
-func New(callable *lua.LFunction, loop loop.Loop) Callback {
-	return &callback{
+func New(callable *lua.LFunction, loop loop.Loop, opts ...Option) Callback {
+	cb := &callback{
 		callable: callable,
 		loop:     loop,
 	}
+
+	cb.key = fmt.Sprintf("callback:%p", cb)
+
+	for _, opt := range opts {
+		opt(cb)
+	}
+
+	return cb
 }
 
 func (cb *callback) Callable() *lua.LFunction {
 	return cb.callable
 }
 
-func (cb *callback) From(fn func(L *lua.LState) []lua.LValue) <-chan error {
-	err := make(chan error, 1)
+func (cb *callback) From(fn func(L *lua.LState) []lua.LValue) loop.Handle {
+	return cb.FromKey("", fn)
+}
 
+func (cb *callback) FromKey(key string, fn func(L *lua.LState) []lua.LValue) loop.Handle {
 	if cb == nil {
-		err <- nil
-		return err
+		return doneHandle{}
 	}
 
-	cb.loop.Schedule(func(state *lua.LState) {
+	if cb.delivery != nil {
+		return cb.delivery.enqueue(key, fn)
+	}
+
+	return cb.schedule(key, fn)
+}
+
+// schedule schedules an invocation of the callback on the loop. The
+// invocation is identified by key and the callback itself
+func (cb *callback) schedule(key string, fn func(L *lua.LState) []lua.LValue) *handle {
+	if key != "" {
+		key = cb.key + ":" + key
+	} else {
+		key = cb.key
+	}
+
+	h := &handle{}
+	h.Handle = cb.loop.ScheduleKeyWithPriority(cb.priority, key, func(state *lua.LState) {
+		loop.SetJobSource(state, loop.FunctionSource(cb.callable))
+
 		args := fn(state)
 		e := state.CallByParam(lua.P{
 			Fn:      cb.callable,
@@ -64,17 +140,21 @@ func (cb *callback) From(fn func(L *lua.LState) []lua.LValue) <-chan error {
 		}, args...)
 
 		if e != nil {
-			log.Printf("error in callback: %s\n", e.Error())
+			loop.ReportError(state, cb.callable, cb.origin, e)
 		}
-		err <- e
+		h.err = e
 	})
 
-	return err
+	return h
 }
 
 // Do executes the callback
-func (cb *callback) Do(args ...lua.LValue) <-chan error {
-	return cb.From(func(_ *lua.LState) []lua.LValue {
+func (cb *callback) Do(args ...lua.LValue) loop.Handle {
+	return cb.DoKey("", args...)
+}
+
+func (cb *callback) DoKey(key string, args ...lua.LValue) loop.Handle {
+	return cb.FromKey(key, func(_ *lua.LState) []lua.LValue {
 		return args
 	})
 }
@@ -84,7 +164,7 @@ func (cb *callback) BindChannelErrors(ch <-chan []lua.LValue) <-chan error {
 	go func() {
 		defer close(errors)
 		for args := range ch {
-			err := <-cb.Do(args...)
+			err := cb.Do(args...).Wait()
 			errors <- err
 		}
 
@@ -119,3 +199,45 @@ func LGetOpt(stack int, L *lua.LState) Callback {
 
 	return nil
 }
+
+// handle wraps the loop.Handle of a callback invocation and reports
+// the error returned by the callback
+type handle struct {
+	loop.Handle
+
+	// err is set by the task before the loop handle is marked as done
+	err error
+}
+
+func (h *handle) Err() error {
+	if err := h.Handle.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case <-h.Done():
+		return h.err
+	default:
+		return nil
+	}
+}
+
+func (h *handle) Wait() error {
+	<-h.Done()
+	return h.Err()
+}
+
+// doneHandle is returned when invoking a nil callback
+type doneHandle struct{}
+
+var closedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (doneHandle) Cancel() bool          { return false }
+func (doneHandle) Done() <-chan struct{} { return closedCh }
+func (doneHandle) Err() error            { return nil }
+func (doneHandle) Wait() error           { return nil }
+func (doneHandle) OnDone(fn func())      { fn() }
@@ -2,7 +2,9 @@ package callback
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ppacher/envel/pkg/loop"
 	lua "github.com/yuin/gopher-lua"
@@ -22,7 +24,7 @@ func Test_SimpleCallback(t *testing.T) {
 		cb = New(fn, loop)
 	})
 
-	err := <-cb.Do(lua.LString("hello"), lua.LString("world"))
+	err := cb.Do(lua.LString("hello"), lua.LString("world")).Wait()
 	if err == nil {
 		t.Errorf("Expected lua callback to return an error but got nil")
 		t.FailNow()
@@ -41,6 +43,54 @@ func Test_SimpleCallback(t *testing.T) {
 	loop.Wait()
 }
 
+func Test_CallbackErrorReporting(t *testing.T) {
+	errs := make(chan *loop.JobError, 1)
+
+	l, _ := loop.New(&loop.Options{
+		OnError: func(err *loop.JobError) {
+			errs <- err
+		},
+	})
+	l.Start(context.Background())
+
+	var cb Callback
+
+	l.ScheduleAndWait(func(vm *lua.LState) {
+		vm.DoString(`
+		function test()
+			error("failed")
+		end`)
+
+		cb = New(vm.GetGlobal("test").(*lua.LFunction), l, WithOrigin("signal:test"))
+	})
+
+	cb.Do().Wait()
+
+	select {
+	case err := <-errs:
+		if err.Source != "<string>:2" {
+			t.Errorf("expected source to be <string>:2 but got %s", err.Source)
+		}
+
+		if err.Origin != "signal:test" {
+			t.Errorf("expected origin to be signal:test but got %s", err.Origin)
+		}
+
+		if err.Message() != "<string>:3: failed" {
+			t.Errorf("unexpected message: %s", err.Message())
+		}
+
+		if err.Stack == "" {
+			t.Errorf("expected a traceback")
+		}
+	default:
+		t.Errorf("expected the error to be reported")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
 func Test_BindChannel(t *testing.T) {
 	loop, _ := loop.New(nil)
 	loop.Start(context.Background())
@@ -74,3 +124,243 @@ func Test_BindChannel(t *testing.T) {
 	loop.Stop()
 	loop.Wait()
 }
+
+// recordingCallback returns a callback that appends its first argument to
+// the returned slice
+func recordingCallback(l loop.Loop, opts ...Option) (Callback, *[]string) {
+	var values []string
+	var cb Callback
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		fn := L.NewFunction(func(L *lua.LState) int {
+			values = append(values, L.CheckString(1))
+			return 0
+		})
+
+		cb = New(fn, l, opts...)
+	})
+
+	return cb, &values
+}
+
+// blockLoop blocks the loop until the returned function is called. The
+// blocking job is not queued anymore once blockLoop returns
+func blockLoop(l loop.Loop) func() {
+	ch := make(chan struct{})
+	running := make(chan struct{})
+	l.Schedule(func(_ *lua.LState) {
+		close(running)
+		<-ch
+	})
+	<-running
+
+	return func() { close(ch) }
+}
+
+func Test_DeliveryCoalesce(t *testing.T) {
+	l, _ := loop.New(nil)
+	l.Start(context.Background())
+
+	cb, values := recordingCallback(l, WithDelivery(Delivery{Coalesce: true}))
+
+	release := blockLoop(l)
+
+	cb.DoKey("a", lua.LString("a1"))
+	replaced := cb.DoKey("a", lua.LString("a2"))
+	cb.DoKey("b", lua.LString("b1"))
+	last := cb.DoKey("a", lua.LString("a3"))
+
+	if err := replaced.Wait(); err != loop.ErrTaskDropped {
+		t.Errorf("expected the replaced invocation to be dropped but got %v", err)
+	}
+
+	release()
+
+	if err := last.Wait(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	l.ScheduleAndWait(func(_ *lua.LState) {
+		if strings.Join(*values, ",") != "a1,b1,a3" {
+			t.Errorf("expected a1,b1,a3 but got %v", *values)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopCoalescePolicy(t *testing.T) {
+	l, _ := loop.New(&loop.Options{
+		Queue: loop.QueueOptions{Capacity: 3, Policy: loop.PolicyCoalesce},
+	})
+	l.Start(context.Background())
+
+	cb, values := recordingCallback(l)
+	other, otherValues := recordingCallback(l)
+
+	release := blockLoop(l)
+
+	// invocations are only replaced once the queue is full
+	first := cb.Do(lua.LString("1"))
+	replaced := cb.Do(lua.LString("2"))
+	x := other.Do(lua.LString("x"))
+	last := cb.Do(lua.LString("3"))
+
+	if err := replaced.Wait(); err != loop.ErrTaskDropped {
+		t.Errorf("expected the replaced invocation to be dropped but got %v", err)
+	}
+
+	release()
+
+	for _, h := range []loop.Handle{first, x, last} {
+		if err := h.Wait(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	l.ScheduleAndWait(func(_ *lua.LState) {
+		if strings.Join(*values, ",") != "1,3" {
+			t.Errorf("expected 1,3 but got %v", *values)
+		}
+
+		if strings.Join(*otherValues, ",") != "x" {
+			t.Errorf("expected x but got %v", *otherValues)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_DeliveryMaxInFlight(t *testing.T) {
+	l, _ := loop.New(nil)
+	l.Start(context.Background())
+
+	cb, values := recordingCallback(l, WithDelivery(Delivery{MaxInFlight: 1}))
+
+	release := blockLoop(l)
+
+	cb.Do(lua.LString("1"))
+	held := cb.Do(lua.LString("2"))
+	last := cb.Do(lua.LString("3"))
+
+	// the second invocation is still held back by the delivery
+	if !held.Cancel() {
+		t.Errorf("expected the held back invocation to be cancelled")
+	}
+
+	if err := held.Err(); err != loop.ErrTaskCancelled {
+		t.Errorf("expected ErrTaskCancelled but got %v", err)
+	}
+
+	release()
+	last.Wait()
+
+	l.ScheduleAndWait(func(_ *lua.LState) {
+		if strings.Join(*values, ",") != "1,3" {
+			t.Errorf("expected 1,3 but got %v", *values)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_DeliveryMinInterval(t *testing.T) {
+	l, _ := loop.New(nil)
+	l.Start(context.Background())
+
+	cb, values := recordingCallback(l, WithDelivery(Delivery{MinInterval: 20 * time.Millisecond}))
+
+	start := time.Now()
+
+	cb.Do(lua.LString("1"))
+	cb.Do(lua.LString("2"))
+	cb.Do(lua.LString("3")).Wait()
+
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("expected invocations to be spread over 40ms but took %s", d)
+	}
+
+	l.ScheduleAndWait(func(_ *lua.LState) {
+		if len(*values) != 3 {
+			t.Errorf("expected 3 invocations but got %v", *values)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_CallbackCall(t *testing.T) {
+	l, _ := loop.New(nil)
+	l.Start(context.Background())
+
+	var cb, slow Callback
+
+	l.ScheduleAndWait(func(vm *lua.LState) {
+		vm.DoString(`
+		function answer(name)
+			return 200, {name = name, tags = {"a", "b"}}, nil
+		end
+
+		function slow()
+			while true do end
+		end`)
+
+		cb = New(vm.GetGlobal("answer").(*lua.LFunction), l)
+		slow = New(vm.GetGlobal("slow").(*lua.LFunction), l)
+	})
+
+	res, err := cb.Call(context.Background(), nil, lua.LString("envel"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(res.Values) != 3 || res.Go[0] != float64(200) || res.Go[2] != nil {
+		t.Errorf("unexpected results: %#v", res.Go)
+	}
+
+	m, ok := res.Go[1].(map[string]interface{})
+	if !ok || m["name"] != "envel" || len(m["tags"].([]interface{})) != 2 {
+		t.Errorf("unexpected table conversion: %#v", res.Go[1])
+	}
+
+	// calling from the loop must not deadlock, even without passing
+	// the LState
+	l.ScheduleAndWait(func(L *lua.LState) {
+		res, err := cb.Call(context.Background(), L, lua.LString("loop"))
+		if err != nil || res.Go[1].(map[string]interface{})["name"] != "loop" {
+			t.Errorf("unexpected result: %v %v", res, err)
+		}
+
+		res, err = cb.Call(context.Background(), nil, lua.LString("nil"))
+		if err != nil || res.Go[1].(map[string]interface{})["name"] != "nil" {
+			t.Errorf("unexpected result: %v %v", res, err)
+		}
+	})
+
+	// a running callback is interrupted once the deadline is exceeded
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := slow.Call(ctx, nil); err == nil {
+		t.Errorf("expected the callback to be interrupted")
+	}
+
+	// callbacks that did not start yet are not executed at all
+	release := blockLoop(l)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := cb.Call(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded but got %v", err)
+	}
+
+	release()
+
+	l.Stop()
+	l.Wait()
+}
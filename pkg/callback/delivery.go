@@ -0,0 +1,326 @@
+package callback
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Delivery configures how invocations of a callback are handed to the loop.
+// The zero value schedules each invocation immediately
+type Delivery struct {
+	// Coalesce keeps only the latest pending invocation per key (see
+	// Callback.FromKey). Invocations for a key are held back while another
+	// invocation for the same key is in flight. Replaced invocations are
+	// finished with loop.ErrTaskDropped
+	Coalesce bool
+
+	// MinInterval is the minimum time between the start of two invocations
+	MinInterval time.Duration
+
+	// MaxInFlight limits the number of invocations that have been scheduled
+	// on the loop but did not finish yet. Zero means unlimited
+	MaxInFlight int
+}
+
+func (d Delivery) enabled() bool {
+	return d.Coalesce || d.MinInterval > 0 || d.MaxInFlight > 0
+}
+
+// WithDelivery configures the delivery mode of the callback
+func WithDelivery(d Delivery) Option {
+	return func(cb *callback) {
+		if d.enabled() {
+			cb.delivery = &delivery{
+				Delivery: d,
+				cb:       cb,
+				keys:     make(map[string]bool),
+			}
+		}
+	}
+}
+
+// Deliver returns a callback that invokes the function of cb using the
+// delivery mode d. Invocations of cb itself are not affected
+func Deliver(cb Callback, d Delivery) Callback {
+	c, ok := cb.(*callback)
+	if !ok || c == nil {
+		return cb
+	}
+
+	delivered := &callback{
+		callable: c.callable,
+		loop:     c.loop,
+		priority: c.priority,
+		origin:   c.origin,
+	}
+	delivered.key = fmt.Sprintf("callback:%p", delivered)
+	WithDelivery(d)(delivered)
+
+	return delivered
+}
+
+// CheckDelivery reads the delivery mode from the fields `coalesce`,
+// `min_interval` (in seconds) and `max_in_flight` of the Lua table t.
+// Missing fields keep their zero value
+func CheckDelivery(L *lua.LState, n int, t *lua.LTable) Delivery {
+	d := Delivery{}
+
+	coalesce := t.RawGetString("coalesce")
+	if v, ok := coalesce.(lua.LBool); ok {
+		d.Coalesce = bool(v)
+	} else if coalesce != lua.LNil {
+		L.ArgError(n, "coalesce must be nil or a boolean")
+	}
+
+	interval := t.RawGetString("min_interval")
+	if v, ok := interval.(lua.LNumber); ok && v >= 0 {
+		d.MinInterval = time.Duration(float64(v) * float64(time.Second))
+	} else if interval != lua.LNil {
+		L.ArgError(n, "min_interval must be nil or a positive number")
+	}
+
+	inFlight := t.RawGetString("max_in_flight")
+	if v, ok := inFlight.(lua.LNumber); ok && v >= 0 {
+		d.MaxInFlight = int(v)
+	} else if inFlight != lua.LNil {
+		L.ArgError(n, "max_in_flight must be nil or a positive number")
+	}
+
+	return d
+}
+
+// invocation is waiting to be scheduled on the loop
+type invocation struct {
+	key string
+	fn  func(*lua.LState) []lua.LValue
+	h   *deliveryHandle
+}
+
+// delivery holds invocations back until they can be scheduled according
+// to the Delivery configuration. Pending invocations do not occupy a
+// goroutine or a slot in the loop queue
+type delivery struct {
+	Delivery
+
+	cb *callback
+
+	lock     sync.Mutex
+	pending  []*invocation
+	inFlight int
+	keys     map[string]bool
+	last     time.Time
+	timer    *time.Timer
+}
+
+func (d *delivery) enqueue(key string, fn func(*lua.LState) []lua.LValue) loop.Handle {
+	h := &deliveryHandle{
+		d:    d,
+		done: make(chan struct{}),
+	}
+
+	d.lock.Lock()
+
+	if d.Coalesce && key != "" {
+		for _, inv := range d.pending {
+			if inv.key != key {
+				continue
+			}
+
+			replaced := inv.h
+			inv.fn = fn
+			inv.h = h
+			d.lock.Unlock()
+
+			replaced.finish(loop.ErrTaskDropped)
+			return h
+		}
+	}
+
+	d.pending = append(d.pending, &invocation{key: key, fn: fn, h: h})
+	ready := d.next()
+	d.lock.Unlock()
+
+	d.dispatch(ready)
+	return h
+}
+
+// next removes all invocations that may be scheduled now from the
+// pending list. It must be called with d.lock held
+func (d *delivery) next() []*invocation {
+	var ready []*invocation
+
+	for i := 0; i < len(d.pending); {
+		if d.MaxInFlight > 0 && d.inFlight >= d.MaxInFlight {
+			break
+		}
+
+		inv := d.pending[i]
+		if d.Coalesce && d.keys[inv.key] {
+			i++
+			continue
+		}
+
+		if d.MinInterval > 0 {
+			wait := time.Until(d.last.Add(d.MinInterval))
+			if wait > 0 {
+				if d.timer == nil {
+					d.timer = time.AfterFunc(wait, d.wakeup)
+				}
+				break
+			}
+		}
+
+		ready = append(ready, inv)
+		d.pending = append(d.pending[:i], d.pending[i+1:]...)
+
+		d.inFlight++
+		d.last = time.Now()
+		if d.Coalesce && inv.key != "" {
+			d.keys[inv.key] = true
+		}
+	}
+
+	return ready
+}
+
+func (d *delivery) wakeup() {
+	d.lock.Lock()
+	d.timer = nil
+	ready := d.next()
+	d.lock.Unlock()
+
+	d.dispatch(ready)
+}
+
+// dispatch schedules invocations on the loop. It must not be called
+// with d.lock held as scheduling may block
+func (d *delivery) dispatch(ready []*invocation) {
+	for _, inv := range ready {
+		inv := inv
+		inner := d.cb.schedule(inv.key, inv.fn)
+		inv.h.setInner(inner)
+
+		inner.OnDone(func() {
+			d.finished(inv, inner.Err())
+		})
+	}
+}
+
+func (d *delivery) finished(inv *invocation, err error) {
+	d.lock.Lock()
+	d.inFlight--
+	delete(d.keys, inv.key)
+	ready := d.next()
+	d.lock.Unlock()
+
+	inv.h.finish(err)
+	d.dispatch(ready)
+}
+
+// cancel removes h from the pending list
+func (d *delivery) cancel(h *deliveryHandle) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, inv := range d.pending {
+		if inv.h == h {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliveryHandle implements loop.Handle for invocations that may still
+// be held back by the delivery
+type deliveryHandle struct {
+	d *delivery
+
+	lock     sync.Mutex
+	inner    loop.Handle
+	err      error
+	finished bool
+	done     chan struct{}
+	onDone   []func()
+}
+
+func (h *deliveryHandle) setInner(inner loop.Handle) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.inner = inner
+}
+
+func (h *deliveryHandle) finish(err error) {
+	h.lock.Lock()
+	if h.finished {
+		h.lock.Unlock()
+		return
+	}
+
+	h.finished = true
+	h.err = err
+	close(h.done)
+
+	onDone := h.onDone
+	h.onDone = nil
+	h.lock.Unlock()
+
+	for _, fn := range onDone {
+		fn()
+	}
+}
+
+func (h *deliveryHandle) Cancel() bool {
+	if h.d.cancel(h) {
+		h.finish(loop.ErrTaskCancelled)
+		return true
+	}
+
+	h.lock.Lock()
+	inner := h.inner
+	h.lock.Unlock()
+
+	if inner != nil {
+		return inner.Cancel()
+	}
+
+	return false
+}
+
+func (h *deliveryHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *deliveryHandle) Err() error {
+	select {
+	case <-h.done:
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return h.err
+	default:
+		return nil
+	}
+}
+
+func (h *deliveryHandle) Wait() error {
+	<-h.done
+	return h.Err()
+}
+
+func (h *deliveryHandle) OnDone(fn func()) {
+	h.lock.Lock()
+	if !h.finished {
+		h.onDone = append(h.onDone, fn)
+		h.lock.Unlock()
+		return
+	}
+	h.lock.Unlock()
+
+	fn()
+}
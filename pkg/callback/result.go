@@ -0,0 +1,200 @@
+package callback
+
+import (
+	"context"
+
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Results holds the values returned by a callback invocation
+type Results struct {
+	// Values holds the raw Lua values. Tables and functions must only be
+	// accessed while executing on the loop
+	Values []lua.LValue
+
+	// Go holds the values converted to Go types using ToGo. The conversion
+	// happens on the loop so Go values are safe to use everywhere
+	Go []interface{}
+}
+
+// Call invokes the callback with args and returns its results. See
+// FromWithResult
+func (cb *callback) Call(ctx context.Context, L *lua.LState, args ...lua.LValue) (*Results, error) {
+	return cb.FromWithResult(ctx, L, func(_ *lua.LState) []lua.LValue {
+		return args
+	})
+}
+
+// FromWithResult invokes the callback with the arguments returned by fn and
+// waits for its results. If the caller already executes on the loop the
+// callback is invoked directly using L or the VM of the loop if L is nil.
+// Otherwise the invocation is scheduled on the loop and FromWithResult blocks
+// until the callback returned or ctx is done. If ctx has a deadline the
+// callback is interrupted once it is exceeded
+func (cb *callback) FromWithResult(ctx context.Context, L *lua.LState, fn func(*lua.LState) []lua.LValue) (*Results, error) {
+	if cb == nil {
+		return &Results{}, nil
+	}
+
+	if L == nil {
+		// waiting for the loop from within the loop would deadlock
+		L = cb.loop.State()
+	}
+
+	if L != nil {
+		return cb.call(ctx, L, fn)
+	}
+
+	var (
+		res *Results
+		err error
+	)
+
+	h := cb.loop.ScheduleWithPriority(cb.priority, func(state *lua.LState) {
+		res, err = cb.call(ctx, state, fn)
+	})
+
+	select {
+	case <-h.Done():
+		if e := h.Err(); e != nil {
+			return nil, e
+		}
+		return res, err
+
+	case <-ctx.Done():
+		if h.Cancel() {
+			return nil, ctx.Err()
+		}
+
+		// the callback is already running and will be interrupted
+		// if ctx has a deadline. We still need to wait for it as
+		// res and err are written by the loop
+		<-h.Done()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+}
+
+// call invokes the callback using L. It must be called on the loop
+func (cb *callback) call(ctx context.Context, L *lua.LState, fn func(*lua.LState) []lua.LValue) (*Results, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if restore := withDeadline(ctx, L); restore != nil {
+		defer restore()
+	}
+
+	loop.SetJobSource(L, loop.FunctionSource(cb.callable))
+
+	args := fn(L)
+	top := L.GetTop()
+
+	err := L.CallByParam(lua.P{
+		Fn:      cb.callable,
+		NRet:    lua.MultRet,
+		Protect: true,
+	}, args...)
+
+	if err != nil {
+		loop.ReportError(L, cb.callable, cb.origin, err)
+		return nil, err
+	}
+
+	n := L.GetTop() - top
+	res := &Results{
+		Values: make([]lua.LValue, n),
+		Go:     make([]interface{}, n),
+	}
+
+	for i := 0; i < n; i++ {
+		res.Values[i] = L.Get(top + 1 + i)
+		res.Go[i] = ToGo(res.Values[i])
+	}
+	L.Pop(n)
+
+	return res, nil
+}
+
+// withDeadline sets ctx on L if its deadline is earlier than the one of the
+// current context of L (e.g. the job timeout of the loop). It returns a
+// function that restores the previous context or nil
+func withDeadline(ctx context.Context, L *lua.LState) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+
+	prev := L.Context()
+	if prev != nil {
+		if d, ok := prev.Deadline(); ok && d.Before(deadline) {
+			return nil
+		}
+	}
+
+	L.SetContext(ctx)
+
+	return func() {
+		if prev != nil {
+			L.SetContext(prev)
+		} else {
+			L.RemoveContext()
+		}
+	}
+}
+
+// ToGo converts v to a Go value. nil, booleans, numbers and strings are
+// converted to their Go counterparts. Tables that form a sequence are
+// converted to []interface{} and all other tables to map[string]interface{}.
+// Functions, userdata and recursive tables are kept as lua.LValue
+func ToGo(v lua.LValue) interface{} {
+	return toGo(v, make(map[*lua.LTable]bool))
+}
+
+func toGo(v lua.LValue, visited map[*lua.LTable]bool) interface{} {
+	switch val := v.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(val)
+	case lua.LNumber:
+		return float64(val)
+	case lua.LString:
+		return string(val)
+	case *lua.LTable:
+		if visited[val] {
+			return val
+		}
+		visited[val] = true
+		defer delete(visited, val)
+
+		if n := val.Len(); n > 0 {
+			list := make([]interface{}, 0, n)
+			isList := true
+
+			val.ForEach(func(key, _ lua.LValue) {
+				if k, ok := key.(lua.LNumber); !ok || int(k) < 1 || int(k) > n || float64(int(k)) != float64(k) {
+					isList = false
+				}
+			})
+
+			if isList {
+				for i := 1; i <= n; i++ {
+					list = append(list, toGo(val.RawGetInt(i), visited))
+				}
+				return list
+			}
+		}
+
+		m := make(map[string]interface{})
+		val.ForEach(func(key, value lua.LValue) {
+			m[key.String()] = toGo(value, visited)
+		})
+		return m
+	default:
+		return v
+	}
+}
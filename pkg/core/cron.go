@@ -0,0 +1,259 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the fire times of a timer
+type Schedule interface {
+	// Next returns the first fire time after t. A zero time is returned
+	// if the schedule will never fire again
+	Next(t time.Time) time.Time
+}
+
+// cronSchedule is a Schedule parsed from a cron expression. All times are
+// evaluated as wall-clock times in loc
+type cronSchedule struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+
+	// domStar and dowStar are true if the respective field was
+	// set to "*". See dayMatches
+	domStar bool
+	dowStar bool
+
+	loc *time.Location
+}
+
+// cronDescriptors maps the supported @-descriptors to their
+// cron expression
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCron parses a standard 5 field cron expression (minute, hour, day of
+// month, month, day of week) or one of the descriptors @yearly, @monthly,
+// @weekly, @daily, @midnight and @hourly. Fields support lists (1,15), ranges
+// (1-5), steps (*/10, 0-30/5) and names for months and weekdays (jan, mon).
+// Sunday may be written as 0 or 7. If loc is nil, time.Local is used.
+//
+// Schedules are evaluated on the wall clock of loc. Fire times that do not
+// exist because of a DST transition are skipped and fire times that exist
+// twice only fire once
+func ParseCron(expr string, loc *time.Location) (Schedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@") {
+		e, ok := cronDescriptors[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("cron: unknown descriptor %q", expr)
+		}
+		expr = e
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: expected 5 fields but got %d in %q", len(fields), expr)
+	}
+
+	s := &cronSchedule{
+		loc:     loc,
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	if err := parseCronField(fields[0], 0, 59, nil, s.minute[:]); err != nil {
+		return nil, fmt.Errorf("cron: minute: %s", err)
+	}
+
+	if err := parseCronField(fields[1], 0, 23, nil, s.hour[:]); err != nil {
+		return nil, fmt.Errorf("cron: hour: %s", err)
+	}
+
+	if err := parseCronField(fields[2], 1, 31, nil, s.dom[:]); err != nil {
+		return nil, fmt.Errorf("cron: day of month: %s", err)
+	}
+
+	if err := parseCronField(fields[3], 1, 12, monthNames, s.month[:]); err != nil {
+		return nil, fmt.Errorf("cron: month: %s", err)
+	}
+
+	// allow 7 for sunday
+	var dow [8]bool
+	if err := parseCronField(fields[4], 0, 7, dayNames, dow[:]); err != nil {
+		return nil, fmt.Errorf("cron: day of week: %s", err)
+	}
+	copy(s.dow[:], dow[:7])
+	if dow[7] {
+		s.dow[0] = true
+	}
+
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+// and marks all matching values in set
+func parseCronField(field string, min, max int, names map[string]int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+
+		start, end := min, max
+
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = parseCronValue(bounds[0], names); err != nil {
+				return err
+			}
+			if end, err = parseCronValue(bounds[1], names); err != nil {
+				return err
+			}
+		default:
+			v, err := parseCronValue(part, names)
+			if err != nil {
+				return err
+			}
+			start = v
+
+			// "5/10" means every 10 starting at 5
+			if step == 1 {
+				end = v
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for i := start; i <= end; i += step {
+			set[i] = true
+		}
+	}
+
+	return nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	return v, nil
+}
+
+// dayMatches checks if the day of t matches the schedule. Like in
+// cron(8), if both day of month and day of week are restricted
+// the day matches if either of them matches
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[t.Weekday()]
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Next implements Schedule.Next
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	after = after.In(s.loc)
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, s.loc).Add(time.Minute)
+
+	// there's always a match within 5 years, otherwise the
+	// expression can never fire (e.g. 30th of february)
+	limit := after.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+
+	for !s.month[t.Month()] {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for !s.hour[t.Hour()] {
+		next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+		if next.Day() != t.Day() {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			goto wrap
+		}
+		t = next
+	}
+
+	for !s.minute[t.Minute()] {
+		next := t.Add(time.Minute)
+		if next.Hour() != t.Hour() {
+			t = next.Truncate(time.Minute)
+			goto wrap
+		}
+		t = next
+	}
+
+	// a wall-clock time that is repeated when DST ends must
+	// only fire once
+	if !wallClock(t).After(wallClock(after)) {
+		t = t.Add(time.Minute)
+		goto wrap
+	}
+
+	return t
+}
+
+// wallClock returns the wall-clock time of t as if it were UTC so
+// times in different offsets can be compared
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_CronNext(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Skipf("time zone database not available: %s", err)
+	}
+
+	cases := []struct {
+		expr  string
+		after string
+		next  string
+	}{
+		// weekdays at 06:45, 2026-10-16 is a friday
+		{"45 6 * * 1-5", "2026-10-16 06:45", "2026-10-19 06:45"},
+		{"45 6 * * mon-fri", "2026-10-16 06:44", "2026-10-16 06:45"},
+		{"0 0 1 * *", "2026-10-16 12:00", "2026-11-01 00:00"},
+		{"@monthly", "2026-12-16 12:00", "2027-01-01 00:00"},
+		{"*/15 * * * *", "2026-10-16 12:01", "2026-10-16 12:15"},
+		{"0 12 29 2 *", "2026-10-16 12:00", "2028-02-29 12:00"},
+		// sunday as 7
+		{"0 8 * * 7", "2026-10-16 12:00", "2026-10-18 08:00"},
+		// day of month OR day of week
+		{"0 8 20 * mon", "2026-10-16 12:00", "2026-10-19 08:00"},
+		// 02:30 does not exist on 2026-03-29 in Europe/Vienna
+		{"30 2 * * *", "2026-03-28 03:00", "2026-03-30 02:30"},
+		{"0 3 * * *", "2026-03-29 00:00", "2026-03-29 03:00"},
+	}
+
+	for _, c := range cases {
+		s, err := ParseCron(c.expr, vienna)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.expr, err)
+			continue
+		}
+
+		after, _ := time.ParseInLocation("2006-01-02 15:04", c.after, vienna)
+		next := s.Next(after).Format("2006-01-02 15:04")
+
+		if next != c.next {
+			t.Errorf("%s: expected next run after %s to be %s but got %s", c.expr, c.after, c.next, next)
+		}
+	}
+}
+
+func Test_CronDSTEnd(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Skipf("time zone database not available: %s", err)
+	}
+
+	// 02:30 exists twice on 2026-10-25 but must only fire once
+	s, _ := ParseCron("30 2 * * *", vienna)
+
+	first := s.Next(time.Date(2026, 10, 25, 0, 0, 0, 0, vienna))
+	second := s.Next(first)
+
+	if first.Format("2006-01-02 15:04") != "2026-10-25 02:30" {
+		t.Errorf("unexpected first run: %s", first)
+	}
+
+	if second.Format("2006-01-02 15:04") != "2026-10-26 02:30" {
+		t.Errorf("unexpected second run: %s", second)
+	}
+}
+
+func Test_CronParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"@every",
+		"foo * * * *",
+	} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
+
+func Test_TimerSchedule(t *testing.T) {
+	l, _ := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		t = _G.__core.timer {
+			schedule = "0 0 1 1 *",
+			timezone = "UTC",
+			callback = function() end,
+		}
+
+		before_start = t:next_run()
+		t:start()
+		next_run = t:next_run()
+		`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if L.GetGlobal("before_start") != lua.LNil {
+			t.Errorf("expected next_run to be nil for stopped timers")
+		}
+
+		next, ok := L.GetGlobal("next_run").(lua.LNumber)
+		if !ok {
+			t.Errorf("expected next_run to return a number")
+			return
+		}
+
+		expected := time.Date(time.Now().UTC().Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+		if int64(next) != expected.Unix() {
+			t.Errorf("expected next run at %s but got %s", expected, time.Unix(int64(next), 0).UTC())
+		}
+
+		if err := L.DoString(`_G.__core.timer{schedule = "* *", callback = function() end}`); err == nil {
+			t.Errorf("expected an invalid cron expression to fail")
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
@@ -1,101 +1,435 @@
 package core
 
 import (
+	"errors"
+	"io"
+	"math"
 	"os/exec"
 	"syscall"
+	"time"
 
 	shellquote "github.com/kballard/go-shellquote"
 	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
 	lua "github.com/yuin/gopher-lua"
 )
 
+const processTypeName = "process"
+
 // AddExec adds the exec package to the lua table m
 func AddExec(L *lua.LState, m *lua.LTable) {
 	t := L.NewTable()
+	L.SetFuncs(t, map[string]lua.LGFunction{
+		"children": execChildren,
+	})
+	t.RawSetString("shell", lua.LString(DefaultShell))
 
 	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"__call": call,
 	}))
 
+	typeMt := L.NewTypeMetatable(processTypeName)
+	L.SetField(typeMt, "__index", L.SetFuncs(L.NewTable(), processTypeAPI))
+
 	m.RawSetString("exec", t)
 }
 
-// call provides `lualib.exec.call()`
+var processTypeAPI = map[string]lua.LGFunction{
+	"pid":         processPid,
+	"write":       processWrite,
+	"close_stdin": processCloseStdin,
+	"kill":        processKill,
+	"wait":        processWait,
+	"resize":      processResize,
+}
+
+// DefaultShell is the shell used to execute commands in shell mode unless
+// configured otherwise using `exec.shell`. It defaults to bash and falls
+// back to sh if bash is not available
+var DefaultShell = func() string {
+	if _, err := exec.LookPath("bash"); err == nil {
+		return "bash -c"
+	}
+
+	return "/bin/sh -c"
+}()
+
+// call provides `lualib.exec.call(cmd, shell, [line_cb], [done_cb], [opts])` and
+// returns a process object. shell is either a boolean or the command line of
+// the shell (e.g. "sh -c") to execute cmd with. If true, the shell configured
+// in `exec.shell` is used. opts may contain the following fields:
+//
+//	env              table of additional environment variables
+//	cwd              working directory of the process
+//	timeout          number of seconds after which the process is killed
+//	stdin            open a pipe to stdin (see process:write())
+//	stdout_callback  called with raw chunks of data written to stdout
+//	stderr_callback  called with raw chunks of data written to stderr
+//	pty              run the command on a pseudo-terminal. stdout and stderr
+//	                 are both reported as stdout and stdin is always available
+//	rows, cols       the initial size of the terminal
 func call(L *lua.LState) int {
 	cmdStr := L.CheckString(2)
-	shell := L.CheckBool(3)
+	shell := checkShell(L, 3, L.Get(3))
 	lineCallback := callback.LGetOpt(4, L)
 	doneCallback := callback.LGetOpt(5, L)
+	opts := L.OptTable(6, nil)
 
-	var cmd []string
+	cmd, err := parseCommand(cmdStr, shell)
+	if err != nil {
+		L.RaiseError(err.Error())
+		return 0
+	}
 
-	if shell {
-		cmd = append([]string{"bash", "-c"}, cmdStr)
-	} else {
-		var err error
-		cmd, err = shellquote.Split(cmdStr)
+	registry := ChildRegistry(loop.LGet(L))
+	procOpts := ProcessOptions{
+		Command:  cmd,
+		Registry: registry,
+	}
 
-		if err != nil {
-			L.RaiseError("invalid command line")
-			return 0
+	var stdoutCallback, stderrCallback callback.Callback
+	if opts != nil {
+		stdoutCallback, stderrCallback = checkProcessOptions(L, 6, opts, &procOpts)
+	}
+
+	procOpts.Stdout = outputCallbacks(lineCallback, stdoutCallback, &LineCallbackOptions{
+		TrimCR: procOpts.Pty,
+	})
+	procOpts.Stderr = outputCallbacks(lineCallback, stderrCallback, &LineCallbackOptions{
+		// stderr should be passed as the second argument to lineCallback
+		PrefixArgs: []lua.LValue{lua.LNil},
+	})
+
+	p, err := StartProcess(procOpts)
+	if err != nil {
+		L.RaiseError("failed to start process: %v", err)
+		return 0
+	}
+
+	if doneCallback != nil {
+		go func() {
+			status, _ := p.Wait()
+
+			// the loop is gone if the process has been terminated
+			// during shutdown
+			if registry.closing() {
+				return
+			}
+
+			doneCallback.Do(lua.LString(status.Reason), lua.LNumber(status.Code)).Wait()
+		}()
+	}
+
+	ud := L.NewUserData()
+	ud.Value = p
+	L.SetMetatable(ud, L.GetTypeMetatable(processTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+// parseCommand splits cmd into the program and its arguments. If shell is
+// set cmd is passed as the last argument to the shell instead
+func parseCommand(cmd string, shell []string) ([]string, error) {
+	if shell != nil {
+		return append(append([]string(nil), shell...), cmd), nil
+	}
+
+	args, err := shellquote.Split(cmd)
+	if err != nil || len(args) == 0 {
+		return nil, errors.New("invalid command line")
+	}
+
+	return args, nil
+}
+
+// checkShell returns the shell command line for value at stack index n. value
+// is either a boolean that enables the shell configured in `exec.shell` or the
+// command line of a shell. nil is returned if no shell should be used
+func checkShell(L *lua.LState, n int, value lua.LValue) []string {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		if !v {
+			return nil
 		}
+		value = configuredShell(L)
+	case lua.LString:
+	default:
+		L.ArgError(n, "shell must be a boolean or a string")
+		return nil
 	}
 
-	c := exec.Command(cmd[0], cmd[1:]...)
+	shell, err := shellquote.Split(value.String())
+	if err != nil || len(shell) == 0 {
+		L.ArgError(n, "invalid shell "+value.String())
+		return nil
+	}
 
-	if lineCallback != nil {
-		stdout, err := c.StdoutPipe()
-		if err != nil {
-			L.RaiseError("failed to create stdout pipe")
-			return 0
+	return shell
+}
+
+// configuredShell returns the value of `__core.exec.shell`
+func configuredShell(L *lua.LState) lua.LValue {
+	if core, ok := L.GetGlobal("__core").(*lua.LTable); ok {
+		if t, ok := core.RawGetString("exec").(*lua.LTable); ok {
+			if shell, ok := t.RawGetString("shell").(lua.LString); ok {
+				return shell
+			}
+		}
+	}
+
+	return lua.LString(DefaultShell)
+}
+
+// checkProcessOptions reads the options of exec.call from t into opts and
+// returns the raw output callbacks
+func checkProcessOptions(L *lua.LState, n int, t *lua.LTable, opts *ProcessOptions) (stdout, stderr callback.Callback) {
+	env := t.RawGetString("env")
+	if tbl, ok := env.(*lua.LTable); ok {
+		opts.Env = make(map[string]string)
+		tbl.ForEach(func(key, value lua.LValue) {
+			k, ok := key.(lua.LString)
+			if !ok {
+				L.ArgError(n, "env keys must be strings")
+			}
+
+			switch v := value.(type) {
+			case lua.LString, lua.LNumber:
+				opts.Env[string(k)] = v.String()
+			default:
+				L.ArgError(n, "env values must be strings or numbers")
+			}
+		})
+	} else if env != lua.LNil {
+		L.ArgError(n, "env must be nil or a table")
+	}
+
+	cwd := t.RawGetString("cwd")
+	if v, ok := cwd.(lua.LString); ok {
+		opts.Dir = string(v)
+	} else if cwd != lua.LNil {
+		L.ArgError(n, "cwd must be nil or a string")
+	}
+
+	timeout := t.RawGetString("timeout")
+	if v, ok := timeout.(lua.LNumber); ok && v > 0 {
+		opts.Timeout = time.Duration(float64(v) * float64(time.Second))
+	} else if timeout != lua.LNil {
+		L.ArgError(n, "timeout must be nil or a positive number")
+	}
+
+	stdin := t.RawGetString("stdin")
+	if v, ok := stdin.(lua.LBool); ok {
+		opts.Stdin = bool(v)
+	} else if stdin != lua.LNil {
+		L.ArgError(n, "stdin must be nil or a boolean")
+	}
+
+	pty := t.RawGetString("pty")
+	if v, ok := pty.(lua.LBool); ok {
+		opts.Pty = bool(v)
+	} else if pty != lua.LNil {
+		L.ArgError(n, "pty must be nil or a boolean")
+	}
+
+	for _, field := range []struct {
+		name string
+		size *uint16
+	}{
+		{"rows", &opts.Rows},
+		{"cols", &opts.Cols},
+	} {
+		value := t.RawGetString(field.name)
+		if v, ok := value.(lua.LNumber); ok && v > 0 && v <= math.MaxUint16 {
+			*field.size = uint16(v)
+		} else if value != lua.LNil {
+			L.ArgError(n, field.name+" must be nil or a positive number")
+		}
+	}
+
+	lo := loop.LGet(L)
+	for _, field := range []struct {
+		name string
+		cb   *callback.Callback
+	}{
+		{"stdout_callback", &stdout},
+		{"stderr_callback", &stderr},
+	} {
+		value := t.RawGetString(field.name)
+		if fn, ok := value.(*lua.LFunction); ok {
+			*field.cb = callback.New(fn, lo)
+		} else if value != lua.LNil {
+			L.ArgError(n, field.name+" must be nil or a function")
+		}
+	}
+
+	return stdout, stderr
+}
+
+// outputCallbacks returns an Output that passes each line to lineCb and each
+// chunk of data to rawCb. Both callbacks are optional
+func outputCallbacks(lineCb, rawCb callback.Callback, opts *LineCallbackOptions) Output {
+	switch {
+	case lineCb == nil && rawCb == nil:
+		return nil
+	case rawCb == nil:
+		return func(r io.Reader) {
+			(&Reader{Reader: r}).ReadLines(lineCb, opts)
 		}
+	case lineCb == nil:
+		return func(r io.Reader) {
+			(&Reader{Reader: r}).ReadChunks(rawCb)
+		}
+	}
+
+	return func(r io.Reader) {
+		pr, pw := io.Pipe()
+		lines := make(chan struct{})
+
+		go func() {
+			defer close(lines)
+			(&Reader{Reader: pr}).ReadLines(lineCb, opts)
+		}()
+
+		(&Reader{Reader: io.TeeReader(r, pw)}).ReadChunks(rawCb)
+		pw.Close()
+		<-lines
+	}
+}
+
+func checkProcess(L *lua.LState) *Process {
+	ud := L.CheckUserData(1)
+	if p, ok := ud.Value.(*Process); ok {
+		return p
+	}
+
+	L.ArgError(1, "expected a "+processTypeName)
+	return nil
+}
+
+// processPid provides `process:pid()`
+func processPid(L *lua.LState) int {
+	p := checkProcess(L)
+	L.Push(lua.LNumber(p.Pid()))
+	return 1
+}
+
+// processWrite provides `process:write(data)` and writes data to the stdin
+// of the process. The process must have been started with the stdin option.
+// An error message is returned if writing failed
+func processWrite(L *lua.LState) int {
+	p := checkProcess(L)
+	data := L.CheckString(2)
+
+	if _, err := p.Write([]byte(data)); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
+	return 0
+}
 
-		stderr, err := c.StderrPipe()
-		if err != nil {
-			L.RaiseError("failed to create stderr pipe")
+// processCloseStdin provides `process:close_stdin()`
+func processCloseStdin(L *lua.LState) int {
+	p := checkProcess(L)
+
+	if err := p.CloseStdin(); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
+	return 0
+}
+
+// processKill provides `process:kill([signal])`. The signal may be passed as
+// a number or a name like "TERM" or "SIGKILL" and defaults to SIGTERM. An
+// error message is returned if the signal could not be delivered
+func processKill(L *lua.LState) int {
+	p := checkProcess(L)
+	sig := syscall.SIGTERM
+
+	switch v := L.Get(2).(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		sig = syscall.Signal(int(v))
+	case lua.LString:
+		s, ok := ParseSignal(string(v))
+		if !ok {
+			L.ArgError(2, "unknown signal "+string(v))
 			return 0
 		}
+		sig = s
+	default:
+		L.ArgError(2, "expected a signal name or number")
+		return 0
+	}
 
-		_, outReader := NewReader(L, stdout)
-		_, errReader := NewReader(L, stderr)
-		outReader.WithLineCallback(lineCallback, nil)
-		errReader.WithLineCallback(lineCallback, &LineCallbackOptions{
-			// stderr should be passed as the second argument to lineCallback
-			PrefixArgs: []lua.LValue{lua.LNil},
-		})
+	if err := p.Kill(sig); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
 	}
 
-	if err := c.Start(); err != nil {
-		L.RaiseError("failed to start process: %v", err)
+	return 0
+}
+
+// processResize provides `process:resize(rows, cols)` and changes the size
+// of the terminal of a process started with the pty option. An error message
+// is returned if resizing failed
+func processResize(L *lua.LState) int {
+	p := checkProcess(L)
+	rows := L.CheckInt(2)
+	cols := L.CheckInt(3)
+
+	if rows <= 0 || rows > math.MaxUint16 {
+		L.ArgError(2, "invalid number of rows")
+		return 0
+	}
+
+	if cols <= 0 || cols > math.MaxUint16 {
+		L.ArgError(3, "invalid number of columns")
 		return 0
 	}
 
-	L.Push(lua.LNumber(c.Process.Pid))
+	if err := p.Resize(uint16(rows), uint16(cols)); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
 
-	go func() {
-		err := c.Wait()
-		if doneCallback != nil {
-			codeOrSignal := 0
-			exitReason := "exit"
-
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				// godoc: -1 f the process hasn't exited or was terminated by a signal
-				// we know that it exited so it must have been a signal
-				if exitErr.ExitCode() == -1 {
-					codeOrSignal = int(exitErr.Sys().(syscall.WaitStatus).Signal())
-					exitReason = "signal"
-				} else {
-					codeOrSignal = exitErr.ExitCode()
-					exitReason = "exit"
-				}
-			} else {
-				// normal exit but with exitCode == 0
-				exitReason = "exit"
+	return 0
+}
+
+// processWait provides `process:wait([cb])`. cb is called with the exit reason
+// and the exit code or signal once the process finished. If cb is omitted a
+// pending operation is returned that can be used with await()
+func processWait(L *lua.LState) int {
+	p := checkProcess(L)
+	cb := callback.LGetOpt(2, L)
+
+	if cb == nil {
+		ud, pending := loop.NewPending(L)
+
+		go func() {
+			status, err := p.Wait()
+			if err != nil {
+				pending.Reject(err)
+				return
 			}
 
-			<-doneCallback.Do(lua.LString(exitReason), lua.LNumber(codeOrSignal))
-		}
+			pending.Resolve(func(L *lua.LState) []lua.LValue {
+				return []lua.LValue{lua.LString(status.Reason), lua.LNumber(status.Code)}
+			})
+		}()
+
+		L.Push(ud)
+		return 1
+	}
+
+	go func() {
+		status, _ := p.Wait()
+		cb.Do(lua.LString(status.Reason), lua.LNumber(status.Code)).Wait()
 	}()
 
-	return 1
+	return 0
 }
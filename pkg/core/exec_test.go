@@ -1,7 +1,10 @@
 package core
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -38,3 +41,202 @@ func Test_ExecCall(t *testing.T) {
 	l.Stop()
 	l.Wait()
 }
+
+func Test_ExecProcess(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		local lines = {}
+		local raw = ""
+
+		local p = exec("cat", false, function(line)
+			if line ~= nil then table.insert(lines, line) end
+		end, function(reason, code)
+			if reason ~= "exit" or code ~= 0 then
+				error("unexpected exit: "..reason.." "..code)
+			end
+			if #lines ~= 2 or lines[1] ~= "hello" or lines[2] ~= "world" then
+				error("unexpected lines")
+			end
+			if raw ~= "hello\nworld\n" then
+				error("unexpected raw output: "..raw)
+			end
+			done()
+		end, {
+			stdin = true,
+			stdout_callback = function(data)
+				if data ~= nil then raw = raw .. data end
+			end,
+		})
+
+		if type(p:pid()) ~= "number" then error("expected a pid") end
+
+		p:write("hello\n")
+		p:write("world\n")
+		p:close_stdin()
+
+		if p:write("again") == nil then error("expected write to fail") end
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("process did not finish")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_ExecOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("dir", lua.LString(dir))
+
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		local out = {}
+		exec("echo $FOO $(pwd)", true, function(line)
+			if line ~= nil then table.insert(out, line) end
+		end, function()
+			if out[1] ~= "bar "..dir then
+				error("unexpected output: "..tostring(out[1]))
+			end
+
+			local p = exec("sleep 10", false, nil, nil, {timeout = 0.05})
+			p:wait(function(reason, code)
+				if reason ~= "timeout" or code ~= 9 then
+					error("unexpected exit: "..reason.." "..code)
+				end
+
+				local s = exec("sleep 10", false)
+				s:wait(function(reason, code)
+					if reason ~= "signal" or code ~= 15 then
+						error("unexpected exit: "..reason.." "..code)
+					end
+					done()
+				end)
+				s:kill("TERM")
+			end)
+		end, {env = {FOO = "bar"}, cwd = dir})
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("processes did not finish")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_ExecShell(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		local out = {}
+		local function collect(line)
+			if line ~= nil then table.insert(out, line) end
+		end
+
+		exec("echo $0", "sh -c", collect, function()
+			exec.shell = "sh -c"
+			exec("echo $0", true, collect, function()
+				if out[1] ~= "sh" or out[2] ~= "sh" then
+					error("unexpected shell: "..tostring(out[1]).." "..tostring(out[2]))
+				end
+				done()
+			end)
+		end)
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("processes did not finish")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_ExecPty(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		local lines = {}
+		local p
+		p = exec("test -t 0 && stty size && read x && stty size", "sh -c", function(line)
+			if line == nil then return end
+			table.insert(lines, line)
+
+			if line == "24 80" then
+				p:resize(30, 100)
+				p:write("\n")
+			end
+		end, function(reason, code)
+			if reason ~= "exit" or code ~= 0 then
+				error("unexpected exit: "..reason.." "..code)
+			end
+			if lines[#lines] ~= "30 100" then
+				error("unexpected output: "..table.concat(lines, "|"))
+			end
+			done()
+		end, {pty = true, rows = 24, cols = 80})
+
+		if exec("true", false):resize(10, 10) == nil then
+			error("expected resize to fail without a terminal")
+		end
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("process did not finish")
+	}
+
+	l.Stop()
+	l.Wait()
+}
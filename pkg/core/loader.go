@@ -24,6 +24,9 @@ func Loader(L *lua.LState) int {
 	AddReader(L, mod)
 	AddExec(L, mod)
 	AddTimer(L, mod)
+	AddScheduler(L, mod)
+	AddSupervisor(L, mod)
+	AddTail(L, mod)
 
 	L.Push(mod)
 
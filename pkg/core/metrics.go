@@ -0,0 +1,21 @@
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	childProcesses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "child_processes",
+		Help: "Current number of running child processes",
+	}, []string{"loop"})
+
+	childStartTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "child_process_start_time_seconds",
+		Help: "Start time of running child processes since unix epoch in seconds",
+	}, []string{"loop", "pid", "command"})
+)
+
+func init() {
+	prometheus.MustRegister(childProcesses, childStartTime)
+}
@@ -0,0 +1,469 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNoStdin is returned when writing to a process that has been started
+// without a stdin pipe or whose stdin has already been closed
+var ErrNoStdin = errors.New("stdin is not available")
+
+// ErrNoPty is returned when resizing the terminal of a process that has
+// not been started on a pseudo-terminal
+var ErrNoPty = errors.New("process has no terminal")
+
+// ErrPtyUnsupported is returned when starting a process on a pseudo-terminal
+// on a platform without support for it
+var ErrPtyUnsupported = errors.New("pseudo-terminals are not supported on this platform")
+
+// Output consumes an output stream of a process. It is executed in a
+// dedicated goroutine and must read r until EOF
+type Output func(r io.Reader)
+
+// ProcessOptions configures a new process
+type ProcessOptions struct {
+	// Command holds the program and its arguments
+	Command []string
+
+	// Env holds additional environment variables. They are added to the
+	// environment of envel and replace variables with the same name
+	Env map[string]string
+
+	// Dir is the working directory of the process. Defaults to the
+	// working directory of envel
+	Dir string
+
+	// Timeout, if set, kills the process with SIGKILL once exceeded
+	Timeout time.Duration
+
+	// Stdin opens a pipe to the standard input of the process. See
+	// Process.Write and Process.CloseStdin
+	Stdin bool
+
+	// Stdout, if set, consumes the standard output of the process.
+	// The output is discarded otherwise
+	Stdout Output
+
+	// Stderr, if set, consumes the standard error of the process.
+	// The output is discarded otherwise
+	Stderr Output
+
+	// Registry, if set, tracks the process until it exits. See
+	// ChildRegistry
+	Registry *Registry
+
+	// Pty runs the process on a pseudo-terminal. Stdin is always available
+	// and the terminal output (stdout and stderr) is passed to Stdout
+	Pty bool
+
+	// Rows and Cols configure the initial size of the terminal if
+	// Pty is set. Zero values keep the default of the system
+	Rows, Cols uint16
+}
+
+// ExitStatus describes why a process finished
+type ExitStatus struct {
+	// Reason is either "exit", "signal" or "timeout"
+	Reason string
+
+	// Code holds the exit code or the number of the signal
+	// that terminated the process
+	Code int
+}
+
+// Process is an external process started by envel. Each process is
+// started in its own process group so it can be terminated together
+// with its children (see KillGroup)
+type Process struct {
+	cmd     *exec.Cmd
+	timeout time.Duration
+	timer   *time.Timer
+	pty     *os.File
+	pipes   []io.Closer
+	outputs sync.WaitGroup
+	done    chan struct{}
+
+	lock     sync.Mutex
+	stdin    io.WriteCloser
+	timedOut bool
+	status   ExitStatus
+	err      error
+}
+
+// StartProcess starts a new process
+func StartProcess(opts ProcessOptions) (*Process, error) {
+	if len(opts.Command) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	cmd := exec.Command(opts.Command[0], opts.Command[1:]...)
+	cmd.Dir = opts.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if len(opts.Env) > 0 {
+		cmd.Env = mergeEnv(os.Environ(), opts.Env)
+	}
+
+	p := &Process{
+		cmd:     cmd,
+		timeout: opts.Timeout,
+		done:    make(chan struct{}),
+	}
+
+	if opts.Pty {
+		if err := p.startTerminal(opts); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	if opts.Stdin {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		p.stdin = stdin
+	}
+
+	var readers []func()
+	for _, output := range []struct {
+		consume Output
+		pipe    func() (io.ReadCloser, error)
+	}{
+		{opts.Stdout, cmd.StdoutPipe},
+		{opts.Stderr, cmd.StderrPipe},
+	} {
+		if output.consume == nil {
+			continue
+		}
+
+		r, err := output.pipe()
+		if err != nil {
+			return nil, err
+		}
+
+		p.pipes = append(p.pipes, r)
+
+		consume := output.consume
+		readers = append(readers, func() {
+			defer p.outputs.Done()
+			consume(r)
+		})
+	}
+
+	if err := p.start(opts.Registry, opts.Command); err != nil {
+		return nil, err
+	}
+
+	p.outputs.Add(len(readers))
+	for _, read := range readers {
+		go read()
+	}
+
+	go p.wait()
+
+	return p, nil
+}
+
+// startTerminal starts the process on a new pseudo-terminal
+func (p *Process) startTerminal(opts ProcessOptions) error {
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+
+	if opts.Rows > 0 || opts.Cols > 0 {
+		if err := setWinsize(master, opts.Rows, opts.Cols); err != nil {
+			master.Close()
+			return err
+		}
+	}
+
+	p.cmd.Stdin = slave
+	p.cmd.Stdout = slave
+	p.cmd.Stderr = slave
+	p.cmd.SysProcAttr = ptySysProcAttr()
+
+	if err := p.start(opts.Registry, opts.Command); err != nil {
+		master.Close()
+		return err
+	}
+
+	p.pty = master
+	p.stdin = terminalInput{master}
+
+	consume := opts.Stdout
+	if consume == nil {
+		// the output must be consumed, otherwise the process blocks
+		// once the terminal buffer is full
+		consume = func(r io.Reader) {
+			io.Copy(ioutil.Discard, r)
+		}
+	}
+
+	p.outputs.Add(1)
+	go func() {
+		defer p.outputs.Done()
+		consume(terminalOutput{master})
+	}()
+
+	go p.wait()
+
+	return nil
+}
+
+// start starts the command and adds it to registry
+func (p *Process) start(registry *Registry, command []string) error {
+	if err := p.cmd.Start(); err != nil {
+		return err
+	}
+
+	if registry != nil {
+		if err := registry.add(p, command); err != nil {
+			p.cmd.Process.Kill()
+			p.cmd.Wait()
+			return err
+		}
+	}
+
+	if p.timeout > 0 {
+		p.timer = time.AfterFunc(p.timeout, p.expire)
+	}
+
+	return nil
+}
+
+// terminalInput writes to the master side of a pseudo-terminal. Closing
+// it sends an end-of-transmission character instead of closing the terminal
+type terminalInput struct {
+	*os.File
+}
+
+func (t terminalInput) Close() error {
+	_, err := t.Write([]byte{4})
+	return err
+}
+
+// terminalOutput reads from the master side of a pseudo-terminal. Linux
+// returns EIO once the slave side has been closed which is reported as EOF
+type terminalOutput struct {
+	*os.File
+}
+
+func (t terminalOutput) Read(b []byte) (int, error) {
+	n, err := t.File.Read(b)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// mergeEnv adds env to environ replacing existing variables
+func mergeEnv(environ []string, env map[string]string) []string {
+	result := make([]string, 0, len(environ)+len(env))
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := env[name]; !ok {
+			result = append(result, kv)
+		}
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+
+	return result
+}
+
+// wait waits for the process to exit. All output streams are consumed
+// before as required by exec.Cmd.Wait
+func (p *Process) wait() {
+	p.outputs.Wait()
+	err := p.cmd.Wait()
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	p.lock.Lock()
+	p.status, p.err = exitStatus(err)
+	if p.timedOut && p.status.Reason == "signal" {
+		p.status.Reason = "timeout"
+	}
+	p.stdin = nil
+	p.lock.Unlock()
+
+	if p.pty != nil {
+		p.pty.Close()
+	}
+
+	close(p.done)
+}
+
+// closeOutputs closes the output pipes or the pseudo-terminal so pending
+// reads return. Descendants that left the process group may keep them open
+// after the process exited which would otherwise block wait forever
+func (p *Process) closeOutputs() {
+	for _, pipe := range p.pipes {
+		pipe.Close()
+	}
+
+	if p.pty != nil {
+		p.pty.Close()
+	}
+}
+
+// exitStatus returns the exit status for the error returned by exec.Cmd.Wait.
+// Errors that are not caused by the process exit are returned as is
+func exitStatus(err error) (ExitStatus, error) {
+	if err == nil {
+		return ExitStatus{Reason: "exit"}, nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return ExitStatus{Reason: "exit", Code: -1}, err
+	}
+
+	// godoc: -1 if the process hasn't exited or was terminated by a signal
+	// we know that it exited so it must have been a signal
+	if exitErr.ExitCode() == -1 {
+		return ExitStatus{
+			Reason: "signal",
+			Code:   int(exitErr.Sys().(syscall.WaitStatus).Signal()),
+		}, nil
+	}
+
+	return ExitStatus{Reason: "exit", Code: exitErr.ExitCode()}, nil
+}
+
+func (p *Process) expire() {
+	p.lock.Lock()
+	p.timedOut = true
+	p.lock.Unlock()
+
+	p.KillGroup(syscall.SIGKILL)
+}
+
+// Pid returns the process ID
+func (p *Process) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Write writes data to the standard input of the process. Write blocks
+// if the process does not consume its input fast enough
+func (p *Process) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	stdin := p.stdin
+	p.lock.Unlock()
+
+	if stdin == nil {
+		return 0, ErrNoStdin
+	}
+
+	return stdin.Write(data)
+}
+
+// CloseStdin closes the standard input of the process
+func (p *Process) CloseStdin() error {
+	p.lock.Lock()
+	stdin := p.stdin
+	p.stdin = nil
+	p.lock.Unlock()
+
+	if stdin == nil {
+		return ErrNoStdin
+	}
+
+	return stdin.Close()
+}
+
+// Kill sends sig to the process
+func (p *Process) Kill(sig syscall.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// Resize changes the size of the terminal of the process
+func (p *Process) Resize(rows, cols uint16) error {
+	if p.pty == nil {
+		return ErrNoPty
+	}
+
+	return setWinsize(p.pty, rows, cols)
+}
+
+// KillGroup sends sig to the process group of the process
+func (p *Process) KillGroup(sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid(), sig)
+}
+
+// Terminate sends SIGTERM to the process group and SIGKILL if the process
+// did not exit within grace. Terminate does not wait for the process to exit
+func (p *Process) Terminate(grace time.Duration) {
+	if err := p.KillGroup(syscall.SIGTERM); err != nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-p.done:
+		case <-time.After(grace):
+			p.KillGroup(syscall.SIGKILL)
+		}
+	}()
+}
+
+// Done returns a channel that is closed once the process exited and
+// all output has been consumed
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits for the process to exit and returns its exit status. The
+// error is only set if waiting for the process failed
+func (p *Process) Wait() (ExitStatus, error) {
+	<-p.done
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.status, p.err
+}
+
+// signals maps signal names accepted by ParseSignal
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+}
+
+// ParseSignal returns the signal for name. The name is case-insensitive
+// and may be prefixed with "SIG"
+func ParseSignal(name string) (syscall.Signal, bool) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	sig, ok := signals[name]
+	return sig, ok
+}
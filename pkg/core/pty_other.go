@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, ErrPtyUnsupported
+}
+
+func setWinsize(f *os.File, rows, cols uint16) error {
+	return ErrPtyUnsupported
+}
+
+func ptySysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
@@ -214,46 +214,83 @@ type LineCallbackOptions struct {
 	// SuffixArgs holds a list of arguments that should be passed to the callback
 	// after the actual line
 	SuffixArgs []lua.LValue
+
+	// TrimCR removes a trailing carriage return from each line (e.g. for
+	// output of a terminal)
+	TrimCR bool
 }
 
 // WithLineCallback starts reading from the reader and calls the provided
 // callback for each line
 func (r *Reader) WithLineCallback(lineCb callback.Callback, opts *LineCallbackOptions) {
+	go r.ReadLines(lineCb, opts)
+}
+
+// ReadLines works like WithLineCallback but blocks until the reader
+// reached EOF and all callback invocations returned
+func (r *Reader) ReadLines(lineCb callback.Callback, opts *LineCallbackOptions) {
 	lineReader := bufio.NewReader(r)
 
 	var prefix []lua.LValue
 	var suffix []lua.LValue
+	trimCR := false
 
 	if opts != nil {
 		prefix = opts.PrefixArgs
 		suffix = opts.SuffixArgs
+		trimCR = opts.TrimCR
 	}
 
-	go func() {
-		for {
-			d, err := lineReader.ReadString('\n')
+	for {
+		d, err := lineReader.ReadString('\n')
 
-			// remove the delimiter if it's set
-			if len(d) > 0 && d[len(d)-1] == '\n' {
-				d = d[:len(d)-1]
-			}
+		// remove the delimiter if it's set
+		if len(d) > 0 && d[len(d)-1] == '\n' {
+			d = d[:len(d)-1]
+		}
 
-			args := append(prefix, lua.LString(d))
-			args = append(args, suffix...)
-			if d != "" {
-				<-lineCb.Do(args...)
+		if trimCR && len(d) > 0 && d[len(d)-1] == '\r' {
+			d = d[:len(d)-1]
+		}
+
+		args := append(prefix, lua.LString(d))
+		args = append(args, suffix...)
+		if d != "" {
+			lineCb.Do(args...).Wait()
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				lineCb.Do(lua.LNil).Wait()
+			} else {
+				lineCb.Do(lua.LNil, lua.LString(err.Error())).Wait()
 			}
+			return
+		}
+	}
+}
 
-			if err != nil {
-				if err == io.EOF {
-					<-lineCb.Do(lua.LNil)
-				} else {
-					<-lineCb.Do(lua.LNil, lua.LString(err.Error()))
-				}
-				return
+// ReadChunks reads from the reader and calls cb with each chunk of data
+// as soon as it is available. Like ReadLines, cb is called with nil once
+// EOF is reached. ReadChunks blocks until then
+func (r *Reader) ReadChunks(cb callback.Callback) {
+	buffer := make([]byte, 4096)
+
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			cb.Do(lua.LString(buffer[:n])).Wait()
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				cb.Do(lua.LNil).Wait()
+			} else {
+				cb.Do(lua.LNil, lua.LString(err.Error())).Wait()
 			}
+			return
 		}
-	}()
+	}
 }
 
 // fromString provides the `reader.from_string()` method that is used
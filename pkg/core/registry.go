@@ -0,0 +1,213 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/ppacher/envel/pkg/loop"
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultGracePeriod is the time children have to exit after receiving
+// SIGTERM when the loop is stopped
+const DefaultGracePeriod = 5 * time.Second
+
+// ErrShuttingDown is returned when starting a process while its
+// registry is shutting down
+var ErrShuttingDown = errors.New("envel is shutting down")
+
+// Child is a process tracked by a Registry
+type Child struct {
+	*Process
+
+	// Command is the command line of the process
+	Command string
+
+	// Started is the time the process has been started
+	Started time.Time
+}
+
+// Registry keeps track of all child processes started for a loop and
+// terminates them once the loop is stopped
+type Registry struct {
+	// Grace is the time children have to exit after receiving SIGTERM
+	// before they are killed
+	Grace time.Duration
+
+	lock     sync.Mutex
+	children map[*Process]*Child
+	closed   bool
+}
+
+var (
+	registriesLock sync.Mutex
+	registries     = make(map[loop.Loop]*Registry)
+)
+
+// ChildRegistry returns the registry for l. It is created on first use and
+// shut down once the loop runs its exit queue
+func ChildRegistry(l loop.Loop) *Registry {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+
+	if r, ok := registries[l]; ok {
+		return r
+	}
+
+	r := &Registry{
+		Grace:    DefaultGracePeriod,
+		children: make(map[*Process]*Child),
+	}
+	registries[l] = r
+
+	l.OnExit(func(*lua.LState) {
+		registriesLock.Lock()
+		delete(registries, l)
+		registriesLock.Unlock()
+
+		r.Shutdown()
+	})
+
+	return r
+}
+
+// add starts tracking p until it exits. If the registry is already shut
+// down ErrShuttingDown is returned
+func (r *Registry) add(p *Process, command []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return ErrShuttingDown
+	}
+
+	child := &Child{
+		Process: p,
+		Command: shellquote.Join(command...),
+		Started: time.Now(),
+	}
+	r.children[p] = child
+
+	pid := strconv.Itoa(p.Pid())
+	childProcesses.With(prometheus.Labels{"loop": "default"}).Inc()
+	childStartTime.With(prometheus.Labels{"loop": "default", "pid": pid, "command": child.Command}).Set(float64(child.Started.Unix()))
+
+	go func() {
+		<-p.Done()
+
+		r.lock.Lock()
+		delete(r.children, p)
+		r.lock.Unlock()
+
+		childProcesses.With(prometheus.Labels{"loop": "default"}).Dec()
+		childStartTime.Delete(prometheus.Labels{"loop": "default", "pid": pid, "command": child.Command})
+	}()
+
+	return nil
+}
+
+// Children returns all running children ordered by their start time
+func (r *Registry) Children() []*Child {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	children := make([]*Child, 0, len(r.children))
+	for _, c := range r.children {
+		children = append(children, c)
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Started.Before(children[j].Started)
+	})
+
+	return children
+}
+
+// Shutdown denies new processes and sends SIGTERM to the process groups
+// of all children. Children that did not exit within the grace period are
+// killed. Shutdown waits until all children exited. Output streams that
+// are still held open by descendants once another grace period passed are
+// closed
+func (r *Registry) Shutdown() {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+
+	children := r.Children()
+	for _, c := range children {
+		c.KillGroup(syscall.SIGTERM)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for _, c := range children {
+			<-c.Done()
+		}
+	}()
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(r.Grace):
+	}
+
+	for _, c := range children {
+		select {
+		case <-c.Done():
+		default:
+			c.KillGroup(syscall.SIGKILL)
+		}
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(r.Grace):
+	}
+
+	// the processes are gone but descendants that left the process
+	// group still hold their output streams
+	for _, c := range children {
+		select {
+		case <-c.Done():
+		default:
+			c.closeOutputs()
+		}
+	}
+
+	<-exited
+}
+
+// closing returns true if the registry has been shut down
+func (r *Registry) closing() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.closed
+}
+
+// execChildren provides `exec.children()` and returns a list of all running
+// children with their pid, command line, start time and uptime in seconds
+func execChildren(L *lua.LState) int {
+	result := L.NewTable()
+
+	for _, c := range ChildRegistry(loop.LGet(L)).Children() {
+		t := L.NewTable()
+		t.RawSetString("pid", lua.LNumber(c.Pid()))
+		t.RawSetString("command", lua.LString(c.Command))
+		t.RawSetString("started", lua.LNumber(c.Started.Unix()))
+		t.RawSetString("uptime", lua.LNumber(time.Since(c.Started).Seconds()))
+
+		result.Append(t)
+	}
+
+	L.Push(result)
+	return 1
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_RegistryChildren(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		local p = exec("sleep 10", false)
+		local children = exec.children()
+
+		if #children ~= 1 then error("expected one child") end
+		if children[1].pid ~= p:pid() then error("unexpected pid") end
+		if children[1].command ~= "sleep 10" then error("unexpected command "..children[1].command) end
+		if type(children[1].uptime) ~= "number" then error("expected an uptime") end
+
+		p:wait(function()
+			if #exec.children() ~= 0 then error("expected no children") end
+			done()
+		end)
+		p:kill()
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("process did not exit")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_RegistryShutdown(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	var (
+		children []*Child
+		sleepPid int
+	)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		// the shell ignores SIGTERM and must be killed once the grace
+		// period is exceeded. The background sleep is part of the same
+		// process group and must be terminated as well
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		exec("sleep 10", false, nil, function()
+			error("done callbacks must not be called during shutdown")
+		end)
+		exec("trap '' TERM; sleep 10 & echo $!; wait", true, function(line)
+			if line ~= nil then
+				sleep_pid = tonumber(line)
+				done()
+			end
+		end)
+		`)
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shell did not start")
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		r := ChildRegistry(l)
+		r.Grace = 100 * time.Millisecond
+		children = r.Children()
+		sleepPid = int(L.GetGlobal("sleep_pid").(lua.LNumber))
+	})
+
+	if len(children) != 2 {
+		t.Fatalf("expected two children but got %d", len(children))
+	}
+
+	start := time.Now()
+	l.Stop()
+	l.Wait()
+
+	for _, c := range children {
+		select {
+		case <-c.Done():
+		default:
+			t.Errorf("expected %q to be terminated", c.Command)
+		}
+
+	}
+
+	// the background process is orphaned and may not be reaped yet
+	if isRunning(sleepPid) {
+		t.Errorf("expected the background process %d to be killed", sleepPid)
+	}
+
+	status, _ := children[1].Wait()
+	if status.Reason != "signal" || status.Code != int(syscall.SIGKILL) {
+		t.Errorf("expected the shell to be killed, got %+v", status)
+	}
+
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("expected the shutdown to wait for the grace period")
+	}
+}
+
+func Test_RegistryShutdownDetached(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	var (
+		children []*Child
+		sleepPid int
+	)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		// the background sleep starts a new session and keeps the output
+		// pipe of the shell open after it has been killed
+		err := L.DoString(`
+		exec = _G.__core.exec
+
+		exec("trap '' TERM; setsid sleep 10 & echo $!; wait", true, function(line)
+			if line ~= nil then
+				sleep_pid = tonumber(line)
+				done()
+			end
+		end)
+		`)
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shell did not start")
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		r := ChildRegistry(l)
+		r.Grace = 100 * time.Millisecond
+		children = r.Children()
+		sleepPid = int(L.GetGlobal("sleep_pid").(lua.LNumber))
+	})
+	defer syscall.Kill(sleepPid, syscall.SIGKILL)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		l.Stop()
+		l.Wait()
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked on the output of a detached process")
+	}
+
+	if len(children) != 1 {
+		t.Fatalf("expected one child but got %d", len(children))
+	}
+
+	status, _ := children[0].Wait()
+	if status.Reason != "signal" || status.Code != int(syscall.SIGKILL) {
+		t.Errorf("expected the shell to be killed, got %+v", status)
+	}
+}
+
+// isRunning returns true if pid exists and is not a zombie
+func isRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+
+	// the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
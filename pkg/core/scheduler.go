@@ -0,0 +1,608 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+const schedulerTypeName = "scheduler"
+
+// AddScheduler adds the scheduler package to the lua table m
+func AddScheduler(L *lua.LState, m *lua.LTable) {
+	t := L.NewTable()
+
+	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newScheduler,
+	}))
+
+	typeMt := L.NewTypeMetatable(schedulerTypeName)
+	L.SetField(typeMt, "__index", L.SetFuncs(L.NewTable(), schedulerTypeAPI))
+
+	m.RawSetString("scheduler", t)
+}
+
+var schedulerTypeAPI = map[string]lua.LGFunction{
+	"handler": schedulerHandler,
+	"at":      schedulerAt,
+	"list":    schedulerList,
+	"cancel":  schedulerCancel,
+}
+
+// CatchUpPolicy defines what happens to jobs that should have been
+// executed while envel was not running
+type CatchUpPolicy string
+
+const (
+	// CatchUpRun executes missed jobs as soon as the scheduler is created
+	CatchUpRun CatchUpPolicy = "run"
+
+	// CatchUpSkip drops missed jobs
+	CatchUpSkip CatchUpPolicy = "skip"
+)
+
+// ScheduledJob is a one-shot job persisted by the Scheduler
+type ScheduledJob struct {
+	// Name uniquely identifies the job
+	Name string `json:"name"`
+
+	// At is the time the job should fire
+	At time.Time `json:"at"`
+
+	// Handler is the name of the Lua handler to invoke
+	Handler string `json:"handler"`
+
+	// Args holds the JSON encoded arguments passed to the handler
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// SchedulerOptions configures a new scheduler
+type SchedulerOptions struct {
+	// Path to the file that stores all pending jobs
+	Path string
+
+	// CatchUp defines what happens to jobs that have been missed.
+	// Defaults to CatchUpRun
+	CatchUp CatchUpPolicy
+
+	// MaxDelay, if set, drops missed jobs that are overdue for more
+	// than MaxDelay even if CatchUp is set to CatchUpRun
+	MaxDelay time.Duration
+}
+
+// redispatchDelay is the time to wait before a job is dispatched again
+// after the loop it has been scheduled on dropped it
+const redispatchDelay = time.Second
+
+type scheduledEntry struct {
+	job   *ScheduledJob
+	timer *time.Timer
+
+	// waiting is set if the job is due but its handler has not
+	// been registered yet
+	waiting bool
+}
+
+// jobFile holds the pending jobs stored at a path. It is shared by all
+// schedulers using the same file (e.g. the ones of the current and the new
+// VM while reloading) so each job is armed and executed only once
+type jobFile struct {
+	path string
+
+	lock sync.Mutex
+	jobs map[string]*scheduledEntry
+
+	// schedulers holds all schedulers using the file. Jobs are
+	// executed by the one created last
+	schedulers []*Scheduler
+}
+
+var (
+	jobFilesLock sync.Mutex
+	jobFiles     = make(map[string]*jobFile)
+)
+
+// Scheduler executes named one-shot jobs at a given time. Pending jobs are
+// stored in a file and re-armed when the scheduler is created again (e.g.
+// after a restart)
+type Scheduler struct {
+	SchedulerOptions
+
+	loop loop.Loop
+	file *jobFile
+
+	lock     sync.Mutex
+	handlers map[string]*lua.LFunction
+}
+
+// NewScheduler creates a new scheduler for l and re-arms all jobs stored
+// in opts.Path. If another loop already uses a scheduler for the same file
+// the pending jobs are shared and the catch-up policy does not apply. Jobs
+// are executed on the loop that created its scheduler last. The scheduler
+// is detached once l exits
+func NewScheduler(l loop.Loop, opts SchedulerOptions) (*Scheduler, error) {
+	if opts.CatchUp == "" {
+		opts.CatchUp = CatchUpRun
+	}
+
+	if opts.CatchUp != CatchUpRun && opts.CatchUp != CatchUpSkip {
+		return nil, fmt.Errorf("unknown catch-up policy %q", opts.CatchUp)
+	}
+
+	abs, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{
+		SchedulerOptions: opts,
+		loop:             l,
+		handlers:         make(map[string]*lua.LFunction),
+	}
+
+	jobFilesLock.Lock()
+	defer jobFilesLock.Unlock()
+
+	f, ok := jobFiles[abs]
+	if !ok {
+		f, err = openJobFile(opts)
+		if err != nil {
+			return nil, err
+		}
+		jobFiles[abs] = f
+	}
+
+	s.file = f
+
+	f.lock.Lock()
+	f.schedulers = append(f.schedulers, s)
+	if !ok {
+		for _, e := range f.jobs {
+			f.arm(e)
+		}
+	}
+	f.lock.Unlock()
+
+	l.OnExit(func(*lua.LState) {
+		f.detach(abs, s)
+	})
+
+	return s, nil
+}
+
+// openJobFile reads all jobs from opts.Path and drops the ones missed
+// according to the catch-up policy
+func openJobFile(opts SchedulerOptions) (*jobFile, error) {
+	jobs, err := loadJobs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &jobFile{
+		path: opts.Path,
+		jobs: make(map[string]*scheduledEntry),
+	}
+
+	now := time.Now()
+	dropped := false
+
+	for _, job := range jobs {
+		if job.At.Before(now) {
+			missed := opts.CatchUp == CatchUpSkip || (opts.MaxDelay > 0 && now.Sub(job.At) > opts.MaxDelay)
+			if missed {
+				log.Printf("scheduler: dropping job %q that should have fired at %s\n", job.Name, job.At)
+				dropped = true
+				continue
+			}
+		}
+
+		f.jobs[job.Name] = &scheduledEntry{job: job}
+	}
+
+	if dropped {
+		if err := f.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// loadJobs reads all jobs from the scheduler file at path
+func loadJobs(path string) ([]*ScheduledJob, error) {
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*ScheduledJob
+	if err := json.Unmarshal(blob, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	return jobs, nil
+}
+
+// detach removes s from the schedulers of the file. Once no scheduler is
+// left all timers are stopped. Jobs stay in the file
+func (f *jobFile) detach(abs string, s *Scheduler) {
+	jobFilesLock.Lock()
+	defer jobFilesLock.Unlock()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, other := range f.schedulers {
+		if other == s {
+			f.schedulers = append(f.schedulers[:i:i], f.schedulers[i+1:]...)
+			break
+		}
+	}
+
+	if len(f.schedulers) > 0 {
+		return
+	}
+
+	for _, e := range f.jobs {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+
+	if jobFiles[abs] == f {
+		delete(jobFiles, abs)
+	}
+}
+
+// saveLocked writes all pending jobs to the file. It must be called
+// with f.lock held
+func (f *jobFile) saveLocked() error {
+	blob, err := json.MarshalIndent(f.jobsLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(f.path, blob, 0600)
+}
+
+// jobsLocked returns all pending jobs ordered by their fire time. It must
+// be called with f.lock held
+func (f *jobFile) jobsLocked() []*ScheduledJob {
+	jobs := make([]*ScheduledJob, 0, len(f.jobs))
+	for _, e := range f.jobs {
+		jobs = append(jobs, e.job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].At.Before(jobs[j].At)
+	})
+
+	return jobs
+}
+
+// arm starts the timer of e. It must be called with f.lock held
+func (f *jobFile) arm(e *scheduledEntry) {
+	e.timer = time.AfterFunc(time.Until(e.job.At), func() {
+		f.dispatch(e, nil)
+	})
+}
+
+// dispatch schedules e on the loop of target or the scheduler created
+// last if target is nil. If the loop drops the job (e.g. because it is
+// shutting down) it is dispatched again after redispatchDelay
+func (f *jobFile) dispatch(e *scheduledEntry, target *Scheduler) {
+	f.lock.Lock()
+	if f.jobs[e.job.Name] != e || len(f.schedulers) == 0 {
+		f.lock.Unlock()
+		return
+	}
+
+	if target == nil {
+		target = f.schedulers[len(f.schedulers)-1]
+	}
+	f.lock.Unlock()
+
+	h := target.loop.Schedule(func(L *lua.LState) {
+		target.fire(L, e)
+	})
+
+	go func() {
+		if h.Wait() != loop.ErrTaskDropped {
+			return
+		}
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if f.jobs[e.job.Name] == e {
+			e.timer = time.AfterFunc(redispatchDelay, func() {
+				f.dispatch(e, nil)
+			})
+		}
+	}()
+}
+
+// Add adds a new job and persists it. A pending job with the same name
+// is replaced
+func (s *Scheduler) Add(job *ScheduledJob) error {
+	f := s.file
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if e, ok := f.jobs[job.Name]; ok && e.timer != nil {
+		e.timer.Stop()
+	}
+
+	e := &scheduledEntry{job: job}
+	f.jobs[job.Name] = e
+	f.arm(e)
+
+	return f.saveLocked()
+}
+
+// Cancel removes the job with the given name. It returns false if there
+// is no such job
+func (s *Scheduler) Cancel(name string) (bool, error) {
+	f := s.file
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	e, ok := f.jobs[name]
+	if !ok {
+		return false, nil
+	}
+
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	delete(f.jobs, name)
+
+	return true, f.saveLocked()
+}
+
+// Jobs returns all pending jobs ordered by their fire time
+func (s *Scheduler) Jobs() []*ScheduledJob {
+	s.file.lock.Lock()
+	defer s.file.lock.Unlock()
+
+	return s.file.jobsLocked()
+}
+
+// Handle registers fn as the handler with the given name. Jobs that are
+// already due and wait for the handler are executed
+func (s *Scheduler) Handle(name string, fn *lua.LFunction) {
+	s.lock.Lock()
+	s.handlers[name] = fn
+	s.lock.Unlock()
+
+	f := s.file
+
+	f.lock.Lock()
+	var waiting []*scheduledEntry
+	for _, e := range f.jobs {
+		if e.waiting && e.job.Handler == name {
+			e.waiting = false
+			waiting = append(waiting, e)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, e := range waiting {
+		f.dispatch(e, s)
+	}
+}
+
+// fire removes the job of e and executes its handler. If the handler
+// is not registered an error is reported and the job is kept until the
+// handler is registered. It is executed inside the loop
+func (s *Scheduler) fire(L *lua.LState, e *scheduledEntry) {
+	job := e.job
+	f := s.file
+
+	s.lock.Lock()
+	handler := s.handlers[job.Handler]
+	s.lock.Unlock()
+
+	f.lock.Lock()
+	if f.jobs[job.Name] != e {
+		f.lock.Unlock()
+		return
+	}
+
+	if handler == nil {
+		e.waiting = true
+		f.lock.Unlock()
+
+		loop.ReportError(L, nil, "scheduler:"+job.Name, fmt.Errorf("no handler %q registered for job %q", job.Handler, job.Name))
+		return
+	}
+
+	delete(f.jobs, job.Name)
+	err := f.saveLocked()
+	f.lock.Unlock()
+
+	if err != nil {
+		log.Printf("scheduler: failed to save %s: %s\n", f.path, err.Error())
+	}
+
+	var args lua.LValue = lua.LNil
+	if len(job.Args) > 0 {
+		var err error
+		args, err = luajson.Decode(L, job.Args)
+		if err != nil {
+			log.Printf("scheduler: invalid arguments for job %q: %s\n", job.Name, err.Error())
+			return
+		}
+	}
+
+	loop.SetJobSource(L, loop.FunctionSource(handler))
+	if err := L.CallByParam(lua.P{
+		Fn:      handler,
+		NRet:    0,
+		Protect: true,
+	}, args, lua.LString(job.Name)); err != nil {
+		loop.ReportError(L, handler, "scheduler:"+job.Name, err)
+	}
+}
+
+// newScheduler provides `scheduler{path = "...", catch_up = "run", max_delay = 3600}`
+func newScheduler(L *lua.LState) int {
+	tbl := L.CheckTable(2)
+
+	opts := SchedulerOptions{}
+
+	if path, ok := tbl.RawGetString("path").(lua.LString); ok {
+		opts.Path = string(path)
+	} else {
+		L.ArgError(1, "path must be set to a string")
+	}
+
+	catchUp := tbl.RawGetString("catch_up")
+	if v, ok := catchUp.(lua.LString); ok {
+		opts.CatchUp = CatchUpPolicy(v)
+	} else if catchUp != lua.LNil {
+		L.ArgError(1, "catch_up must be nil or a string")
+	}
+
+	maxDelay := tbl.RawGetString("max_delay")
+	if v, ok := maxDelay.(lua.LNumber); ok {
+		opts.MaxDelay = time.Duration(float64(v) * float64(time.Second))
+	} else if maxDelay != lua.LNil {
+		L.ArgError(1, "max_delay must be nil or a number")
+	}
+
+	s, err := NewScheduler(loop.LGet(L), opts)
+	if err != nil {
+		L.RaiseError("scheduler: %s", err.Error())
+		return 0
+	}
+
+	ud := L.NewUserData()
+	ud.Value = s
+	L.SetMetatable(ud, L.GetTypeMetatable(schedulerTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+func checkScheduler(L *lua.LState) *Scheduler {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*Scheduler); ok {
+		return s
+	}
+
+	L.ArgError(1, "expected a scheduler object")
+	return nil
+}
+
+// schedulerHandler provides `scheduler:handler(name, fn)` and registers fn
+// as the handler with the given name. Handlers are called with the arguments
+// of the job and its name. Due jobs waiting for the handler are executed
+func schedulerHandler(L *lua.LState) int {
+	s := checkScheduler(L)
+	name := L.CheckString(2)
+	fn := L.CheckFunction(3)
+
+	s.Handle(name, fn)
+
+	return 0
+}
+
+// schedulerAt provides `scheduler:at{name=..., at=timestamp, handler=..., args=...}`.
+// Instead of `at` the number of seconds from now may be passed as `in`. The
+// arguments must be JSON serializable
+func schedulerAt(L *lua.LState) int {
+	s := checkScheduler(L)
+	tbl := L.CheckTable(2)
+
+	job := &ScheduledJob{}
+
+	if v, ok := tbl.RawGetString("name").(lua.LString); ok {
+		job.Name = string(v)
+	} else {
+		L.ArgError(2, "name must be set to a string")
+	}
+
+	if v, ok := tbl.RawGetString("handler").(lua.LString); ok {
+		job.Handler = string(v)
+	} else {
+		L.ArgError(2, "handler must be set to a string")
+	}
+
+	if v, ok := tbl.RawGetString("at").(lua.LNumber); ok {
+		job.At = time.Unix(0, int64(float64(v)*float64(time.Second)))
+	} else if v, ok := tbl.RawGetString("in").(lua.LNumber); ok {
+		job.At = time.Now().Add(time.Duration(float64(v) * float64(time.Second)))
+	} else {
+		L.ArgError(2, "either at or in must be set to a number")
+	}
+
+	if args := tbl.RawGetString("args"); args != lua.LNil {
+		blob, err := luajson.Encode(args)
+		if err != nil {
+			L.ArgError(2, fmt.Sprintf("args must be JSON serializable: %s", err.Error()))
+		}
+		job.Args = blob
+	}
+
+	if err := s.Add(job); err != nil {
+		L.RaiseError("scheduler: %s", err.Error())
+	}
+
+	return 0
+}
+
+// schedulerList returns a list of all pending jobs
+func schedulerList(L *lua.LState) int {
+	s := checkScheduler(L)
+
+	list := L.NewTable()
+	for _, job := range s.Jobs() {
+		t := L.NewTable()
+		t.RawSetString("name", lua.LString(job.Name))
+		t.RawSetString("at", lua.LNumber(float64(job.At.UnixNano())/float64(time.Second)))
+		t.RawSetString("handler", lua.LString(job.Handler))
+
+		if len(job.Args) > 0 {
+			args, err := luajson.Decode(L, job.Args)
+			if err == nil {
+				t.RawSetString("args", args)
+			}
+		}
+
+		list.Append(t)
+	}
+
+	L.Push(list)
+	return 1
+}
+
+// schedulerCancel cancels the job with the given name and returns true
+// if the job existed
+func schedulerCancel(L *lua.LState) int {
+	s := checkScheduler(L)
+	name := L.CheckString(2)
+
+	ok, err := s.Cancel(name)
+	if err != nil {
+		L.RaiseError("scheduler: %s", err.Error())
+	}
+
+	L.Push(lua.LBool(ok))
+	return 1
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ppacher/envel/pkg/loop"
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_Scheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.json")
+
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("path", lua.LString(path))
+
+		err := L.DoString(`
+		s = _G.__core.scheduler{path = path}
+
+		s:handler("finish", function(args, name)
+			if name ~= "soon" or args.value ~= 42 then
+				error("unexpected job "..name)
+			end
+			done()
+		end)
+
+		s:at{name = "soon", handler = "finish", ["in"] = 0.01, args = {value = 42}}
+		s:at{name = "later", handler = "finish", ["in"] = 3600}
+		s:at{name = "cancelled", handler = "finish", ["in"] = 3600}
+
+		if not s:cancel("cancelled") then error("expected cancel to return true") end
+		if s:cancel("unknown") then error("expected cancel to return false") end
+
+		if #s:list() ~= 2 then error("expected two jobs") end
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job did not fire")
+	}
+
+	l.Stop()
+	l.Wait()
+
+	// the pending job must survive a restart
+	jobs, err := loadJobs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].Name != "later" {
+		t.Errorf("expected only job \"later\" to be pending but got %v", jobs)
+	}
+}
+
+func Test_SchedulerCatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.json")
+	err = ioutil.WriteFile(path, []byte(`[
+		{"name": "missed", "at": "2020-01-01T00:00:00Z", "handler": "run", "args": "missed"},
+		{"name": "recent", "at": "`+time.Now().Add(-time.Minute).Format(time.RFC3339)+`", "handler": "run", "args": "recent"}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("path", lua.LString(path))
+
+		err := L.DoString(`
+		s = _G.__core.scheduler{path = path, catch_up = "run", max_delay = 3600}
+
+		if #s:list() ~= 1 then error("expected the outdated job to be dropped") end
+
+		s:handler("run", function(args)
+			if args ~= "recent" then error("unexpected job "..tostring(args)) end
+			done()
+		end)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("missed job did not run")
+	}
+
+	l.Stop()
+	l.Wait()
+
+	blob, _ := ioutil.ReadFile(path)
+	if string(blob) != "[]" {
+		t.Errorf("expected no pending jobs but got %s", blob)
+	}
+}
+
+func Test_SchedulerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.json")
+
+	current, _ := getLibTestLoop(t)
+	next, _ := getLibTestLoop(t)
+
+	fired := make(chan string, 2)
+	script := func(l loop.Loop, name string, schedule bool) {
+		l.ScheduleAndWait(func(L *lua.LState) {
+			L.SetGlobal("path", lua.LString(path))
+			L.SetGlobal("fired", L.NewFunction(func(L *lua.LState) int {
+				fired <- name
+				return 0
+			}))
+			L.SetGlobal("schedule", lua.LBool(schedule))
+
+			err := L.DoString(`
+			s = _G.__core.scheduler{path = path}
+			s:handler("run", function() fired() end)
+			if schedule then
+				s:at{name = "soon", handler = "run", ["in"] = 0.05}
+			end
+			`)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// while reloading both VMs use the same file. The job must
+	// only be executed once and by the new VM
+	script(current, "current", true)
+	script(next, "next", false)
+
+	select {
+	case name := <-fired:
+		if name != "next" {
+			t.Errorf("expected the job to be executed by the new VM but got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job did not fire")
+	}
+
+	select {
+	case name := <-fired:
+		t.Errorf("job fired twice (%s)", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	current.Stop()
+	current.Wait()
+	next.Stop()
+	next.Wait()
+}
+
+func Test_SchedulerMissingHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.json")
+
+	origins := make(chan string, 1)
+	l, done := helper.GetTestLoop(t, func(L *lua.LState) {
+		L.Push(L.NewFunction(Loader))
+		L.Call(0, 0)
+	})
+
+	l.OnEvent(func(name string, args ...lua.LValue) {
+		if name == "envel::error" {
+			origins <- args[3].String()
+		}
+	})
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("path", lua.LString(path))
+
+		err := L.DoString(`
+		s = _G.__core.scheduler{path = path}
+		s:at{name = "job", handler = "late", ["in"] = 0.01, args = 42}
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case origin := <-origins:
+		if origin != "scheduler:job" {
+			t.Errorf("unexpected error origin %q", origin)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error for the missing handler")
+	}
+
+	// the job must be kept and executed once the handler is registered
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		assert(#s:list() == 1, "expected the job to be kept")
+
+		s:handler("late", function(args)
+			if args ~= 42 then error("unexpected arguments") end
+			done()
+		end)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job did not run once the handler has been registered")
+	}
+
+	l.Stop()
+	l.Wait()
+}
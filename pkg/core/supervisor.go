@@ -0,0 +1,356 @@
+package core
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const supervisorTypeName = "supervisor"
+
+// AddSupervisor adds the supervisor package to the lua table m
+func AddSupervisor(L *lua.LState, m *lua.LTable) {
+	t := L.NewTable()
+
+	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newSupervisor,
+	}))
+
+	typeMt := L.NewTypeMetatable(supervisorTypeName)
+	L.SetField(typeMt, "__index", L.SetFuncs(L.NewTable(), supervisorTypeAPI))
+
+	m.RawSetString("supervisor", t)
+}
+
+var supervisorTypeAPI = map[string]lua.LGFunction{
+	"stop":       supervisorStop,
+	"is_running": supervisorIsRunning,
+	"pid":        supervisorPid,
+}
+
+// SupervisorOptions configures a new supervisor
+type SupervisorOptions struct {
+	ProcessOptions
+
+	// MinBackoff is the delay before the first restart. It is doubled for
+	// each consecutive restart. Defaults to one second
+	MinBackoff time.Duration
+
+	// MaxBackoff limits the delay between two restarts. Defaults to one
+	// minute
+	MaxBackoff time.Duration
+
+	// ResetAfter resets the backoff once the process has been running
+	// for the given duration. Defaults to MaxBackoff
+	ResetAfter time.Duration
+
+	// StopTimeout is the time a process has to exit after receiving SIGTERM
+	// before it is killed. Defaults to five seconds
+	StopTimeout time.Duration
+
+	// OnStart, if set, is called each time the process has been started
+	OnStart func(p *Process)
+
+	// OnExit, if set, is called each time the process exited
+	OnExit func(status ExitStatus)
+
+	// OnRestart, if set, is called before waiting delay to restart
+	// the process
+	OnRestart func(delay time.Duration)
+}
+
+// Supervisor keeps a process running and restarts it with an exponential
+// backoff whenever it exits or fails to start
+type Supervisor struct {
+	SupervisorOptions
+
+	stop chan struct{}
+	done chan struct{}
+
+	lock    sync.Mutex
+	stopped bool
+	current *Process
+}
+
+// NewSupervisor creates a new supervisor and starts the process
+func NewSupervisor(opts SupervisorOptions) *Supervisor {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Minute
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	if opts.ResetAfter <= 0 {
+		opts.ResetAfter = opts.MaxBackoff
+	}
+
+	if opts.StopTimeout <= 0 {
+		opts.StopTimeout = 5 * time.Second
+	}
+
+	s := &Supervisor{
+		SupervisorOptions: opts,
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *Supervisor) run() {
+	defer close(s.done)
+
+	delay := s.MinBackoff
+
+	for {
+		s.lock.Lock()
+		if s.stopped {
+			s.lock.Unlock()
+			return
+		}
+
+		p, err := StartProcess(s.ProcessOptions)
+		s.current = p
+		s.lock.Unlock()
+
+		if err == ErrShuttingDown {
+			return
+		}
+
+		if err != nil {
+			log.Printf("supervisor: failed to start %v: %s\n", s.Command, err.Error())
+		} else {
+			started := time.Now()
+
+			if s.OnStart != nil {
+				s.OnStart(p)
+			}
+
+			status, _ := p.Wait()
+
+			s.lock.Lock()
+			s.current = nil
+			s.lock.Unlock()
+
+			if s.OnExit != nil {
+				s.OnExit(status)
+			}
+
+			if time.Since(started) >= s.ResetAfter {
+				delay = s.MinBackoff
+			}
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if s.OnRestart != nil {
+			s.OnRestart(delay)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > s.MaxBackoff {
+			delay = s.MaxBackoff
+		}
+	}
+}
+
+// Stop stops supervising the process and terminates it. See
+// SupervisorOptions.StopTimeout. It is safe to call Stop multiple times
+func (s *Supervisor) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	s.stopped = true
+	close(s.stop)
+
+	if s.current != nil {
+		s.current.Terminate(s.StopTimeout)
+	}
+}
+
+// Wait waits until the supervisor has been stopped and the process exited.
+// Output and exit callbacks are scheduled on the loop so Wait must not be
+// called from the loop unless it is shutting down
+func (s *Supervisor) Wait() {
+	<-s.done
+}
+
+// Running returns the currently running process or nil
+func (s *Supervisor) Running() *Process {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.current
+}
+
+// newSupervisor provides `__core.supervisor{cmd, [shell], ...}`. Additionally
+// to the options of exec the following fields are supported:
+//
+//	line_callback     called for each line printed to stdout or stderr
+//	start_callback    called with the PID each time the process started
+//	exit_callback     called with the exit reason and code
+//	restart_callback  called with the delay in seconds before a restart
+//	backoff           delay before the first restart in seconds
+//	max_backoff       maximum delay between two restarts in seconds
+//	reset_after       reset the backoff after the process has been running
+//	                  for the given number of seconds
+//
+// The process is terminated once the supervisor is stopped or the loop exits
+func newSupervisor(L *lua.LState) int {
+	tbl := L.CheckTable(2)
+	lo := loop.LGet(L)
+
+	cmdStr, ok := tbl.RawGetString("cmd").(lua.LString)
+	if !ok {
+		L.ArgError(1, "cmd must be a string")
+		return 0
+	}
+
+	shell := checkShell(L, 1, tbl.RawGetString("shell"))
+
+	cmd, err := parseCommand(string(cmdStr), shell)
+	if err != nil {
+		L.RaiseError(err.Error())
+		return 0
+	}
+
+	opts := SupervisorOptions{}
+	opts.Command = cmd
+	opts.Registry = ChildRegistry(lo)
+
+	stdoutCallback, stderrCallback := checkProcessOptions(L, 1, tbl, &opts.ProcessOptions)
+
+	callbacks := make(map[string]callback.Callback)
+	for _, name := range []string{"line_callback", "start_callback", "exit_callback", "restart_callback"} {
+		value := tbl.RawGetString(name)
+		if fn, ok := value.(*lua.LFunction); ok {
+			callbacks[name] = callback.New(fn, lo, callback.WithOrigin("supervisor:"+name))
+		} else if value != lua.LNil {
+			L.ArgError(1, name+" must be nil or a function")
+		}
+	}
+
+	for _, field := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"backoff", &opts.MinBackoff},
+		{"max_backoff", &opts.MaxBackoff},
+		{"reset_after", &opts.ResetAfter},
+	} {
+		value := tbl.RawGetString(field.name)
+		if v, ok := value.(lua.LNumber); ok && v > 0 {
+			*field.d = time.Duration(float64(v) * float64(time.Second))
+		} else if value != lua.LNil {
+			L.ArgError(1, field.name+" must be nil or a positive number")
+		}
+	}
+
+	opts.Stdout = outputCallbacks(callbacks["line_callback"], stdoutCallback, &LineCallbackOptions{
+		TrimCR: opts.Pty,
+	})
+	opts.Stderr = outputCallbacks(callbacks["line_callback"], stderrCallback, &LineCallbackOptions{
+		PrefixArgs: []lua.LValue{lua.LNil},
+	})
+
+	if cb := callbacks["start_callback"]; cb != nil {
+		opts.OnStart = func(p *Process) {
+			cb.Do(lua.LNumber(p.Pid())).Wait()
+		}
+	}
+
+	if cb := callbacks["exit_callback"]; cb != nil {
+		opts.OnExit = func(status ExitStatus) {
+			cb.Do(lua.LString(status.Reason), lua.LNumber(status.Code)).Wait()
+		}
+	}
+
+	if cb := callbacks["restart_callback"]; cb != nil {
+		opts.OnRestart = func(delay time.Duration) {
+			cb.Do(lua.LNumber(delay.Seconds())).Wait()
+		}
+	}
+
+	s := NewSupervisor(opts)
+
+	// all jobs scheduled while the loop shuts down are dropped so
+	// it's safe to wait for the process here
+	lo.OnExit(func(*lua.LState) {
+		s.Stop()
+		s.Wait()
+	})
+
+	ud := L.NewUserData()
+	ud.Value = s
+	L.SetMetatable(ud, L.GetTypeMetatable(supervisorTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+func checkSupervisor(L *lua.LState) *Supervisor {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*Supervisor); ok {
+		return s
+	}
+
+	L.ArgError(1, "expected a "+supervisorTypeName)
+	return nil
+}
+
+// supervisorStop provides `supervisor:stop()`
+func supervisorStop(L *lua.LState) int {
+	s := checkSupervisor(L)
+	s.Stop()
+
+	return 0
+}
+
+// supervisorIsRunning provides `supervisor:is_running()`
+func supervisorIsRunning(L *lua.LState) int {
+	s := checkSupervisor(L)
+	L.Push(lua.LBool(s.Running() != nil))
+
+	return 1
+}
+
+// supervisorPid provides `supervisor:pid()` and returns the PID of the
+// running process or nil
+func supervisorPid(L *lua.LState) int {
+	s := checkSupervisor(L)
+
+	p := s.Running()
+	if p == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	L.Push(lua.LNumber(p.Pid()))
+	return 1
+}
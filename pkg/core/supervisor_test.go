@@ -0,0 +1,145 @@
+package core
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_Supervisor(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local starts = 0
+		local exits = 0
+		local lines = 0
+		local delays = {}
+
+		local s
+		s = _G.__core.supervisor {
+			cmd = "echo running; exit 3",
+			shell = true,
+			backoff = 0.01,
+			max_backoff = 0.02,
+			line_callback = function(line)
+				if line == "running" then lines = lines + 1 end
+			end,
+			start_callback = function(pid)
+				if type(pid) ~= "number" then error("expected a pid") end
+				starts = starts + 1
+			end,
+			exit_callback = function(reason, code)
+				if reason ~= "exit" or code ~= 3 then
+					error("unexpected exit: "..reason.." "..code)
+				end
+				exits = exits + 1
+			end,
+			restart_callback = function(delay)
+				table.insert(delays, delay)
+				if #delays == 3 then
+					s:stop()
+					if starts ~= 3 or exits ~= 3 or lines ~= 3 then
+						error("unexpected number of runs")
+					end
+					if delays[1] ~= 0.01 or delays[2] ~= 0.02 or delays[3] ~= 0.02 then
+						error("unexpected backoff")
+					end
+					done()
+				end
+			end,
+		}
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor did not restart the process")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_SupervisorStop(t *testing.T) {
+	exited := make(chan ExitStatus, 1)
+	started := make(chan *Process, 1)
+
+	s := NewSupervisor(SupervisorOptions{
+		ProcessOptions: ProcessOptions{
+			Command: []string{"sleep", "10"},
+		},
+		OnStart: func(p *Process) {
+			started <- p
+		},
+		OnExit: func(status ExitStatus) {
+			exited <- status
+		},
+		OnRestart: func(time.Duration) {
+			t.Error("unexpected restart")
+		},
+	})
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("process did not start")
+	}
+
+	s.Stop()
+	s.Wait()
+
+	status := <-exited
+	if status.Reason != "signal" || status.Code != int(syscall.SIGTERM) {
+		t.Errorf("unexpected exit status %+v", status)
+	}
+
+	if s.Running() != nil {
+		t.Error("expected no process to be running")
+	}
+}
+
+func Test_SupervisorLoopExit(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		s = _G.__core.supervisor {
+			cmd = "sleep 10",
+			start_callback = function() done() end,
+		}
+		`)
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("process did not start")
+	}
+
+	var p *Process
+	l.ScheduleAndWait(func(L *lua.LState) {
+		p = L.GetGlobal("s").(*lua.LUserData).Value.(*Supervisor).Running()
+	})
+
+	l.Stop()
+	l.Wait()
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("expected the process to be terminated")
+	}
+}
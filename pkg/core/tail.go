@@ -0,0 +1,389 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const tailTypeName = "tail"
+
+// AddTail adds the tail package to the lua table m
+func AddTail(L *lua.LState, m *lua.LTable) {
+	t := L.NewTable()
+
+	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newTail,
+	}))
+
+	typeMt := L.NewTypeMetatable(tailTypeName)
+	L.SetField(typeMt, "__index", L.SetFuncs(L.NewTable(), tailTypeAPI))
+
+	m.RawSetString("tail", t)
+}
+
+var tailTypeAPI = map[string]lua.LGFunction{
+	"stop":   tailStop,
+	"offset": tailOffset,
+}
+
+// TailOptions configures a new Tail
+type TailOptions struct {
+	// Path is the path of the file to follow
+	Path string
+
+	// FromEnd starts reading at the end of the file. Offset is
+	// ignored if set
+	FromEnd bool
+
+	// Offset is the position to start reading at (e.g. a previously saved
+	// Tail.Offset). Reading starts at the beginning if the file is smaller
+	// than Offset
+	Offset int64
+
+	// PollInterval is the time to wait for new data once the end of the
+	// file has been reached. Defaults to 250 milliseconds
+	PollInterval time.Duration
+}
+
+// Tail follows a file like `tail -F`. It implements io.Reader and blocks at
+// the end of the file until new data is appended. If the file is replaced
+// (e.g. renamed by logrotate) the new file is read from the beginning once
+// the old one has been read completely. If the file is truncated, reading
+// restarts at the beginning. Each call to Read returns at most one line so
+// Offset points to the end of the last line passed to a line callback (see
+// Reader.WithLineCallback). Incomplete lines are held back until they are
+// terminated so a Tail resumed at Offset does not lose the rest of a line
+// that was written while it has been closed. The last line of a rotated
+// file is terminated by Read if it is incomplete
+type Tail struct {
+	TailOptions
+
+	stop chan struct{}
+
+	lock    sync.Mutex
+	file    *os.File
+	offset  int64
+	pending []byte
+	buf     []byte
+	flush   bool
+	closed  bool
+}
+
+// NewTail creates a new Tail. The file does not need to exist yet
+func NewTail(opts TailOptions) (*Tail, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 250 * time.Millisecond
+	}
+
+	t := &Tail{
+		TailOptions: opts,
+		stop:        make(chan struct{}),
+		buf:         make([]byte, 4096),
+	}
+
+	f, err := os.Open(opts.Path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	switch {
+	case opts.FromEnd:
+		t.offset = stat.Size()
+	case opts.Offset > stat.Size():
+		// the file has been truncated or replaced in the meantime
+		t.offset = 0
+	default:
+		t.offset = opts.Offset
+	}
+
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	t.file = f
+	return t, nil
+}
+
+// Offset returns the position in the current file up to which data has
+// been returned by Read
+func (t *Tail) Offset() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.offset
+}
+
+// Read implements io.Reader. It returns io.EOF once the Tail is closed
+func (t *Tail) Read(p []byte) (int, error) {
+	for {
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			return 0, io.EOF
+		}
+
+		if t.flush {
+			n := t.flushLine(p)
+			t.lock.Unlock()
+
+			return n, nil
+		}
+
+		// lines that do not fit into p are returned in parts
+		if i := bytes.IndexByte(t.pending, '\n'); i >= 0 || len(t.pending) >= len(p) {
+			n := len(t.pending)
+			if i >= 0 {
+				n = i + 1
+			}
+
+			n = copy(p, t.pending[:n])
+			t.pending = t.pending[n:]
+			t.offset += int64(n)
+			t.lock.Unlock()
+
+			return n, nil
+		}
+
+		read := len(t.pending)
+		if err := t.fill(); err != nil {
+			t.lock.Unlock()
+			return 0, err
+		}
+
+		if len(t.pending) > read || t.flush {
+			t.lock.Unlock()
+			continue
+		}
+		t.lock.Unlock()
+
+		select {
+		case <-t.stop:
+		case <-time.After(t.PollInterval):
+		}
+	}
+}
+
+// flushLine returns the incomplete line held back before the file has been
+// rotated or truncated followed by a line break. It must be called with
+// t.lock held
+func (t *Tail) flushLine(p []byte) int {
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	t.offset += int64(n)
+
+	// the line break is not part of the file and not counted
+	// by the offset
+	if len(t.pending) == 0 && n < len(p) {
+		p[n] = '\n'
+		n++
+		t.flush = false
+	}
+
+	return n
+}
+
+// fill appends the next chunk of data to t.pending. If the end of the file
+// has been reached it checks if the file has been rotated or truncated. An
+// incomplete line held back in t.pending is flushed before switching to the
+// new data. It must be called with t.lock held
+func (t *Tail) fill() error {
+	if t.file == nil {
+		f, err := os.Open(t.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		t.file = f
+		t.offset = 0
+	}
+
+	n, err := t.file.Read(t.buf)
+	if n > 0 {
+		t.pending = append(t.pending, t.buf[:n]...)
+		return nil
+	}
+
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	current, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// data held back has already been read from the file
+	read := t.offset + int64(len(t.pending))
+
+	if current.Size() < read {
+		// the file has been truncated
+		if len(t.pending) > 0 {
+			t.flush = true
+			return nil
+		}
+
+		t.offset = 0
+		_, err := t.file.Seek(0, io.SeekStart)
+		return err
+	}
+
+	stat, err := os.Stat(t.Path)
+	if err != nil || os.SameFile(current, stat) {
+		// the file did not change or has been renamed and the
+		// new one has not been created yet
+		return nil
+	}
+
+	// the file has been replaced. Data may have been written to the
+	// old file before it has been renamed so we only switch to the
+	// new file once the old one has been read completely
+	if current.Size() > read {
+		return nil
+	}
+
+	if len(t.pending) > 0 {
+		t.flush = true
+		return nil
+	}
+
+	t.file.Close()
+	t.file = nil
+
+	return nil
+}
+
+// Close stops following the file. Pending and future calls to
+// Read return io.EOF
+func (t *Tail) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	t.closed = true
+	close(t.stop)
+
+	if t.file != nil {
+		return t.file.Close()
+	}
+
+	return nil
+}
+
+// newTail provides `__core.tail{path, line_callback, [from_end], [offset], [poll_interval]}`.
+// line_callback is called for each line appended to the file and with nil
+// once the tail is stopped. Reading starts at the end of the file unless
+// offset is set or from_end is false. The tail is stopped when the loop exits
+func newTail(L *lua.LState) int {
+	tbl := L.CheckTable(2)
+	lo := loop.LGet(L)
+
+	opts := TailOptions{
+		FromEnd: true,
+	}
+
+	path, ok := tbl.RawGetString("path").(lua.LString)
+	if !ok {
+		L.ArgError(1, "path must be a string")
+		return 0
+	}
+	opts.Path = string(path)
+
+	fn, ok := tbl.RawGetString("line_callback").(*lua.LFunction)
+	if !ok {
+		L.ArgError(1, "line_callback must be a function")
+		return 0
+	}
+
+	offset := tbl.RawGetString("offset")
+	if v, ok := offset.(lua.LNumber); ok && v >= 0 {
+		opts.Offset = int64(v)
+		opts.FromEnd = false
+	} else if offset != lua.LNil {
+		L.ArgError(1, "offset must be nil or a positive number")
+	}
+
+	fromEnd := tbl.RawGetString("from_end")
+	if v, ok := fromEnd.(lua.LBool); ok {
+		opts.FromEnd = bool(v)
+	} else if fromEnd != lua.LNil {
+		L.ArgError(1, "from_end must be nil or a boolean")
+	}
+
+	interval := tbl.RawGetString("poll_interval")
+	if v, ok := interval.(lua.LNumber); ok && v > 0 {
+		opts.PollInterval = time.Duration(float64(v) * float64(time.Second))
+	} else if interval != lua.LNil {
+		L.ArgError(1, "poll_interval must be nil or a positive number")
+	}
+
+	t, err := NewTail(opts)
+	if err != nil {
+		L.RaiseError("tail: %s", err.Error())
+		return 0
+	}
+
+	r := &Reader{Reader: t}
+	r.WithLineCallback(callback.New(fn, lo, callback.WithOrigin("tail:"+opts.Path)), nil)
+
+	lo.OnExit(func(*lua.LState) {
+		t.Close()
+	})
+
+	ud := L.NewUserData()
+	ud.Value = t
+	L.SetMetatable(ud, L.GetTypeMetatable(tailTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+func checkTail(L *lua.LState) *Tail {
+	ud := L.CheckUserData(1)
+	if t, ok := ud.Value.(*Tail); ok {
+		return t
+	}
+
+	L.ArgError(1, "expected a "+tailTypeName)
+	return nil
+}
+
+// tailStop provides `tail:stop()`
+func tailStop(L *lua.LState) int {
+	t := checkTail(L)
+	t.Close()
+
+	return 0
+}
+
+// tailOffset provides `tail:offset()` and returns the position in the file
+// after the line that has been passed to the line callback most recently.
+// It can be saved and passed as the offset option to resume later
+func tailOffset(L *lua.LState) int {
+	t := checkTail(L)
+	L.Push(lua.LNumber(t.Offset()))
+
+	return 1
+}
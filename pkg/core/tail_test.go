@@ -0,0 +1,236 @@
+package core
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_TailRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.log")
+	appendFile(t, path, "old\n")
+
+	tail, err := NewTail(TailOptions{
+		Path:         path,
+		FromEnd:      true,
+		PollInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+
+	// like line callbacks, the next line is only read once the
+	// current one has been processed
+	lines := make(chan string)
+	ack := make(chan struct{})
+	go func() {
+		defer close(lines)
+
+		r := bufio.NewReader(tail)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+			<-ack
+		}
+	}()
+
+	expect := func(line string, offset int64) {
+		select {
+		case l := <-lines:
+			if l != line {
+				t.Errorf("expected %q but got %q", line, l)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q", line)
+		}
+
+		if o := tail.Offset(); o != offset {
+			t.Errorf("expected offset %d but got %d", offset, o)
+		}
+		ack <- struct{}{}
+	}
+
+	appendFile(t, path, "first\nsecond\n")
+	expect("first\n", 10)
+	expect("second\n", 17)
+
+	// rename rotation: the remaining data of the old file must be
+	// read before switching to the new one
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "third\n")
+	appendFile(t, path, "fourth\n")
+	expect("third\n", 23)
+	expect("fourth\n", 7)
+
+	// truncate rotation
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	appendFile(t, path, "fifth\n")
+	expect("fifth\n", 6)
+
+	tail.Close()
+	if _, ok := <-lines; ok {
+		t.Error("expected the reader to return EOF once closed")
+	}
+}
+
+func Test_TailOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.log")
+	appendFile(t, path, "first\nsecond\n")
+
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("path", lua.LString(path))
+
+		err := L.DoString(`
+		local t
+		t = _G.__core.tail {
+			path = path,
+			offset = 6,
+			poll_interval = 0.001,
+			line_callback = function(line)
+				if line == nil then return end
+
+				if line ~= "second" then error("unexpected line "..line) end
+				if t:offset() ~= 13 then error("unexpected offset "..t:offset()) end
+
+				t:stop()
+				done()
+			end,
+		}
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("line callback not called")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_TailPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envel-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.log")
+	appendFile(t, path, "first\nsec")
+
+	follow := func(offset int64) (*Tail, <-chan string) {
+		tail, err := NewTail(TailOptions{
+			Path:         path,
+			Offset:       offset,
+			PollInterval: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := make(chan string, 10)
+		go func() {
+			defer close(lines)
+
+			r := bufio.NewReader(tail)
+			for {
+				line, err := r.ReadString('\n')
+				if line != "" {
+					lines <- line
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		return tail, lines
+	}
+
+	expect := func(lines <-chan string, line string) {
+		select {
+		case l := <-lines:
+			if l != line {
+				t.Errorf("expected %q but got %q", line, l)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q", line)
+		}
+	}
+
+	// the incomplete line is neither returned nor counted by the
+	// offset when stopping in the middle of a write
+	tail, lines := follow(0)
+	expect(lines, "first\n")
+	time.Sleep(10 * time.Millisecond)
+	tail.Close()
+
+	if l, ok := <-lines; ok {
+		t.Errorf("expected no more lines but got %q", l)
+	}
+
+	if o := tail.Offset(); o != 6 {
+		t.Errorf("expected offset 6 but got %d", o)
+	}
+
+	appendFile(t, path, "ond\nthi")
+
+	tail, lines = follow(tail.Offset())
+	defer tail.Close()
+	expect(lines, "second\n")
+
+	// the last line of a rotated file is terminated
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "rd")
+	appendFile(t, path, "fourth\n")
+	expect(lines, "third\n")
+	expect(lines, "fourth\n")
+}
@@ -33,14 +33,19 @@ var timerTypeAPI = map[string]lua.LGFunction{
 	"stop":       timerStop,
 	"again":      timerAgain,
 	"is_started": timerStarted,
+	"next_run":   timerNextRun,
 }
 
 // TimerOptions holds configuration options for a new timer
 type TimerOptions struct {
 	// Timeout for the timer. After each timeout, the Callback function is invoked
-	// this field MUST be set
+	// this field MUST be set if Schedule is nil
 	Timeout time.Duration
 
+	// Schedule, if set, defines the fire times of the timer (e.g. a cron
+	// expression parsed by ParseCron). Timeout is ignored in this case
+	Schedule Schedule
+
 	// Autostart defines whether the time should start immediately
 	Autostart bool
 
@@ -52,14 +57,35 @@ type TimerOptions struct {
 
 	// SingleShot configures the timer to automaticall stop after the first timeout
 	SingleShot bool
+
+	// Priority is the loop lane used for timer ticks
+	Priority loop.Priority
+
+	// Origin is reported for errors returned by the callback.
+	// Defaults to "timer"
+	Origin string
 }
 
+// Timer invokes a callback periodically. Ticks are scheduled on the event loop
+// and the next tick is only scheduled after the callback returned, so a slow
+// callback never leads to overlapping ticks
 type Timer struct {
 	*TimerOptions
 
-	wg     sync.WaitGroup
-	stopCh chan struct{}
-	lock   sync.Mutex
+	loop loop.Loop
+	lock sync.Mutex
+
+	started bool
+
+	// generation is incremented each time the timer is started so
+	// ticks of a previous run can detect that they are outdated
+	generation int
+
+	// next is the time of the next tick
+	next time.Time
+
+	// tick is the handle of the next scheduled tick
+	tick loop.Handle
 }
 
 // Start starts the timer if its not running
@@ -67,11 +93,91 @@ func (t *Timer) Start() {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	if t.stopCh == nil {
-		t.stopCh = make(chan struct{}, 1)
-		t.wg.Add(1)
-		go t.run()
+	if t.started {
+		return
 	}
+
+	next := t.nextAfter(time.Now())
+	if next.IsZero() {
+		return
+	}
+
+	t.started = true
+	t.generation++
+	t.next = next
+	t.schedule(t.generation)
+}
+
+// nextAfter returns the next fire time of the timer after now
+func (t *Timer) nextAfter(now time.Time) time.Time {
+	if t.Schedule != nil {
+		return t.Schedule.Next(now)
+	}
+
+	return now.Add(t.Timeout)
+}
+
+// schedule schedules the next tick for generation. The caller must
+// hold the timer lock
+func (t *Timer) schedule(generation int) {
+	t.tick = t.loop.ScheduleAtWithPriority(t.next, t.Priority, func(L *lua.LState) {
+		t.fire(L, generation)
+	})
+}
+
+// fire executes the timer callback and schedules the next tick. It
+// is executed inside the loop
+func (t *Timer) fire(L *lua.LState, generation int) {
+	t.lock.Lock()
+	if !t.started || t.generation != generation {
+		t.lock.Unlock()
+		return
+	}
+	t.tick = nil
+	if t.SingleShot {
+		t.started = false
+	}
+	t.lock.Unlock()
+
+	loop.SetJobSource(L, loop.FunctionSource(t.Callback.Callable()))
+	if err := L.CallByParam(lua.P{
+		Fn:      t.Callback.Callable(),
+		NRet:    0,
+		Protect: true,
+	}); err != nil {
+		origin := t.Origin
+		if origin == "" {
+			origin = "timer"
+		}
+
+		loop.ReportError(L, t.Callback.Callable(), origin, err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// the timer may have been stopped or restarted by the callback
+	if !t.started || t.generation != generation {
+		return
+	}
+
+	now := time.Now()
+	if t.Schedule != nil {
+		t.next = t.Schedule.Next(now)
+		if t.next.IsZero() {
+			t.started = false
+			return
+		}
+	} else {
+		// keep the phase of the timer but skip ticks that have been
+		// missed because the callback or the loop was too slow
+		t.next = t.next.Add(t.Timeout)
+		if t.next.Before(now) {
+			t.next = now.Add(t.Timeout)
+		}
+	}
+
+	t.schedule(generation)
 }
 
 // Init initializes the timer. If CallNow is set, Init() will try to execute the callback.
@@ -97,58 +203,45 @@ func (t *Timer) Init(L *lua.LState) error {
 		} else {
 			// schedule an immediate invocation of the callback
 			// and wait for it to finish
-			err = <-t.Callback.Do()
+			err = t.Callback.Do().Wait()
 		}
 	}
 
 	return err
 }
 
-func (t *Timer) run() {
+// Stop stops the timer if its running. A tick that has already been
+// scheduled but not yet executed is cancelled
+func (t *Timer) Stop() {
 	t.lock.Lock()
-	ch := t.stopCh
-	t.lock.Unlock()
-
-	defer func() {
-		t.lock.Lock()
-		defer t.lock.Unlock()
-		t.stopCh = nil
-		t.wg.Done()
-	}()
-
-	ticker := time.NewTicker(t.Timeout)
-
-	for {
-		select {
-		case _, _ = <-ch:
-			return
-		case <-ticker.C:
-			go func() { <-t.Callback.Do() }()
+	defer t.lock.Unlock()
 
-			if t.SingleShot {
-				go t.Stop()
-			}
-		}
+	t.started = false
+	if t.tick != nil {
+		t.tick.Cancel()
+		t.tick = nil
 	}
 }
 
-// Stop stops the timer if its running
-func (t *Timer) Stop() {
+// IsStarted returns true if the timer is started
+func (t *Timer) IsStarted() bool {
 	t.lock.Lock()
-	if t.stopCh != nil {
-		close(t.stopCh)
-	}
-	t.lock.Unlock()
+	defer t.lock.Unlock()
 
-	t.wg.Wait()
+	return t.started
 }
 
-// IsStarted returns true if the timer is started
-func (t *Timer) IsStarted() bool {
+// NextRun returns the time of the next tick or a zero time if the
+// timer is not started
+func (t *Timer) NextRun() time.Time {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	return t.stopCh != nil
+	if !t.started {
+		return time.Time{}
+	}
+
+	return t.next
 }
 
 // Again restart the time. This is equalent to calling .Stop() and .Start()
@@ -163,6 +256,7 @@ func (t *Timer) Again() {
 func NewTimer(L *lua.LState, opts TimerOptions) (*lua.LUserData, *Timer) {
 	timer := &Timer{
 		TimerOptions: &opts,
+		loop:         loop.LGet(L),
 	}
 
 	ud := L.NewUserData()
@@ -178,9 +272,40 @@ func newTimer(L *lua.LState) int {
 
 	opts := TimerOptions{}
 
+	loc := time.Local
+	timezone := argsTable.RawGetString("timezone")
+	if val, ok := timezone.(lua.LString); ok {
+		l, err := time.LoadLocation(string(val))
+		if err != nil {
+			L.ArgError(1, fmt.Sprintf("invalid timezone: %s", err.Error()))
+		}
+		loc = l
+	} else if timezone != lua.LNil {
+		L.ArgError(1, "timezone must be a string or nil")
+	}
+
 	timeout := argsTable.RawGetString("timeout")
-	if val, ok := timeout.(lua.LNumber); ok {
+	schedule := argsTable.RawGetString("schedule")
+
+	if val, ok := schedule.(lua.LString); ok {
+		s, err := ParseCron(string(val), loc)
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		opts.Schedule = s
+	} else if ud, ok := schedule.(*lua.LUserData); ok {
+		s, ok := ud.Value.(Schedule)
+		if !ok {
+			L.ArgError(1, "schedule must be a cron expression or a schedule object")
+		}
+		opts.Schedule = s
+	} else if schedule != lua.LNil {
+		L.ArgError(1, "schedule must be a cron expression or nil")
+	} else if val, ok := timeout.(lua.LNumber); ok {
 		opts.Timeout = time.Duration(float64(val) * float64(time.Second))
+		if opts.Timeout <= 0 {
+			L.ArgError(1, "timeout must be a positive number")
+		}
 	} else {
 		L.ArgError(1, fmt.Sprintf("timeout must be a number. got: %s (%v)", timeout.Type().String(), timeout))
 	}
@@ -203,9 +328,19 @@ func newTimer(L *lua.LState) int {
 		}
 	}
 
+	priority := loop.PriorityNormal
+	if v := argsTable.RawGetString("priority"); v != lua.LNil {
+		p, err := loop.ParsePriority(lua.LVAsString(v))
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		priority = p
+	}
+	opts.Priority = priority
+
 	cb := argsTable.RawGetString("callback")
 	if fn, ok := cb.(*lua.LFunction); ok {
-		opts.Callback = callback.New(fn, loop.LGet(L))
+		opts.Callback = callback.New(fn, loop.LGet(L), callback.WithPriority(priority))
 	} else {
 		L.ArgError(1, "callback must be set to a function")
 	}
@@ -263,3 +398,18 @@ func timerStarted(L *lua.LState) int {
 	L.Push(lua.LBool(t.IsStarted()))
 	return 1
 }
+
+// timerNextRun returns the time of the next tick as a unix timestamp
+// or nil if the timer is not started
+func timerNextRun(L *lua.LState) int {
+	t := checkTimer(L)
+
+	next := t.NextRun()
+	if next.IsZero() {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	L.Push(lua.LNumber(float64(next.UnixNano()) / float64(time.Second)))
+	return 1
+}
@@ -52,3 +52,108 @@ func Test_Timer(t *testing.T) {
 	l.Stop()
 	l.Wait()
 }
+
+func Test_TimerStopCancelsTick(t *testing.T) {
+	l, _ := getLibTestLoop(t)
+
+	var timer *Timer
+
+	// block the loop until the timer has queued a tick
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		res = 0
+
+		t = _G.__core.timer {
+			timeout = 0.01,
+			single_shot = true,
+			callback = function()
+				res = res + 1
+			end
+		}
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+
+		timer = L.GetGlobal("t").(*lua.LUserData).Value.(*Timer)
+		timer.Start()
+
+		time.Sleep(50 * time.Millisecond)
+		timer.Stop()
+	})
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if res := L.GetGlobal("res"); res != lua.LNumber(0) {
+			t.Errorf("expected the queued tick to be cancelled but res is %v", res)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_TimerSlowCallback(t *testing.T) {
+	l, done := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("block", L.NewFunction(func(L *lua.LState) int {
+			time.Sleep(30 * time.Millisecond)
+			return 0
+		}))
+
+		err := L.DoString(`
+		res = 0
+
+		t = _G.__core.timer {
+			timeout = 0.01,
+			callback = function()
+				res = res + 1
+				block()
+				if res == 3 then
+					t:stop()
+					done()
+				end
+			end
+		}
+
+		t:start()
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// no ticks must have been queued while the callback was running
+	time.Sleep(50 * time.Millisecond)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if res := L.GetGlobal("res"); res != lua.LNumber(3) {
+			t.Errorf("expected 3 ticks but got %v", res)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_TimerInvalidTimeout(t *testing.T) {
+	l, _ := getLibTestLoop(t)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		for _, timeout := range []string{"0", "-1"} {
+			err := L.DoString(`_G.__core.timer { timeout = ` + timeout + `, callback = function() end }`)
+			if err == nil {
+				t.Errorf("expected timeout %s to be rejected", timeout)
+			}
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
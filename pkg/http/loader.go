@@ -3,6 +3,7 @@ package http
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -10,13 +11,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ppacher/envel/pkg/callback"
 	"github.com/ppacher/envel/pkg/core"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
+// Preload preloads the envel.bindings.http and envel.bindings.http.server
+// modules
 func Preload(L *lua.LState) {
 	L.PreloadModule("envel.bindings.http", Loader)
+	L.PreloadModule("envel.bindings.http.server", ServerLoader)
 }
 
 func Loader(L *lua.LState) int {
@@ -59,8 +64,72 @@ func assertTable(L *lua.LState, value lua.LValue, key string, def *lua.LTable) *
 	return def
 }
 
+// httpDo performs a HTTP request. If a callback function is passed as the
+// second argument the request is executed in the background and the response
+// (or an error) is delivered to the callback. Otherwise httpDo blocks the event
+// loop until the response has been received
 func httpDo(L *lua.LState) int {
-	request := L.CheckTable(2)
+	req := checkRequest(L, 2)
+	cb := callback.LGetOpt(3, L)
+
+	if cb != nil {
+		go doAsync(req, cb)
+		return 0
+	}
+
+	cli := newClient()
+
+	res, err := cli.Do(req)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+
+		log.Printf("http request failed: %s\n", err.Error())
+		return 2
+	}
+
+	L.Push(convertResponseToTable(L, res, res.Body))
+
+	return 1
+}
+
+// doAsync executes req and delivers the response to cb. The response body is
+// read completely before cb is scheduled so reading from the body reader inside
+// the callback does not block the event loop
+func doAsync(req *http.Request, cb callback.Callback) {
+	cli := newClient()
+
+	res, err := cli.Do(req)
+	if err != nil {
+		log.Printf("http request failed: %s\n", err.Error())
+		cb.Do(lua.LNil, lua.LString(err.Error())).Wait()
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("http request failed: %s\n", err.Error())
+		cb.Do(lua.LNil, lua.LString(err.Error())).Wait()
+		return
+	}
+
+	cb.From(func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{
+			convertResponseToTable(L, res, bytes.NewReader(body)),
+		}
+	}).Wait()
+}
+
+func newClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Second * 30, // TODO(ppacher): make it configurable
+	}
+}
+
+// checkRequest converts the request table at stack index arg to a *http.Request
+func checkRequest(L *lua.LState, arg int) *http.Request {
+	request := L.CheckTable(arg)
 
 	method := assertString(L, request, "method")
 	urlS := assertString(L, request, "url")
@@ -102,35 +171,20 @@ func httpDo(L *lua.LState) int {
 	u, err := url.Parse(urlS)
 	if err != nil {
 		L.RaiseError("expected an url: " + err.Error())
-		return 0
+		return nil
 	}
 
-	req := &http.Request{
+	return &http.Request{
 		Method: strings.ToUpper(method),
 		URL:    u,
 		Body:   ioutil.NopCloser(bytes.NewBufferString(body)),
 		Header: httpHeader,
 	}
-
-	cli := http.Client{
-		Timeout: time.Second * 30, // TODO(ppacher): make it configurable
-	}
-
-	res, err := cli.Do(req)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-
-		log.Printf("http request failed: %s\n", err.Error())
-		return 2
-	}
-
-	L.Push(convertResponseToTable(L, res))
-
-	return 1
 }
 
-func convertResponseToTable(L *lua.LState, res *http.Response) *lua.LTable {
+// convertResponseToTable converts res to a lua table. The body of the response
+// is read from body
+func convertResponseToTable(L *lua.LState, res *http.Response, body io.Reader) *lua.LTable {
 	t := L.NewTable()
 
 	t.RawSetString("status", lua.LString(res.Status))
@@ -146,7 +200,9 @@ func convertResponseToTable(L *lua.LState, res *http.Response) *lua.LTable {
 		headers.RawSetString(key, ht)
 	}
 
-	reader, _ := core.NewReader(L, res.Body)
+	t.RawSetString("headers", headers)
+
+	reader, _ := core.NewReader(L, body)
 
 	t.RawSetString("body", reader)
 
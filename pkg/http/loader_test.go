@@ -0,0 +1,100 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ppacher/envel/pkg/core"
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func getTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "hello world")
+	}))
+}
+
+func Test_HTTPAsync(t *testing.T) {
+	srv := getTestServer()
+	defer srv.Close()
+
+	l, done := helper.GetTestLoop(t, core.OpenCore, Preload)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("url", lua.LString(srv.URL))
+		err := L.DoString(`
+		local http = require("envel.bindings.http")
+
+		http({method = "POST", url = url}, function(res, err)
+			if err ~= nil then
+				error("unexpected error: "..err)
+			end
+
+			if res.status_code ~= 201 then
+				error("expected status code 201 but got "..tostring(res.status_code))
+			end
+
+			if res.headers["X-Method"][1] ~= "POST" then
+				error("expected X-Method header to be POST")
+			end
+
+			local body = res.body:read("*a")
+			if body ~= "hello world" then
+				error("expected body to be 'hello world' but got "..tostring(body))
+			end
+
+			done()
+		end)
+		`)
+
+		if err != nil {
+			t.Error(err)
+			close(done)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Errorf("timeout waiting for the HTTP callback")
+	}
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_HTTPSync(t *testing.T) {
+	srv := getTestServer()
+	defer srv.Close()
+
+	l, _ := helper.GetTestLoop(t, core.OpenCore, Preload)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("url", lua.LString(srv.URL))
+		err := L.DoString(`
+		local http = require("envel.bindings.http")
+
+		local res, err = http{method = "GET", url = url}
+		if err ~= nil then
+			error("unexpected error: "..err)
+		end
+
+		if res.body:read("*a") ~= "hello world" then
+			error("unexpected body")
+		end
+		`)
+
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
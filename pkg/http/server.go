@@ -0,0 +1,476 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const serverTypeName = "http_server"
+
+// maxRequestBodySize limits the number of bytes read from a request body
+const maxRequestBodySize = 10 << 20
+
+// ServerLoader is the module loader for envel.bindings.http.server
+func ServerLoader(L *lua.LState) int {
+	tbl := L.NewTable()
+
+	typeMt := L.NewTypeMetatable(serverTypeName)
+	L.SetField(typeMt, "__index", L.SetFuncs(L.NewTable(), serverTypeAPI))
+	L.SetField(tbl, "__server_mt", typeMt)
+
+	L.SetMetatable(tbl, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"__call": newServer,
+	}))
+
+	L.Push(tbl)
+	return 1
+}
+
+var serverTypeAPI = map[string]lua.LGFunction{
+	"route":   serverRoute,
+	"address": serverAddress,
+	"close":   serverClose,
+}
+
+// Server is a HTTP server that dispatches requests to lua handlers
+// registered via `server:route()`
+type Server struct {
+	lock     sync.RWMutex
+	routes   []*route
+	listener *sharedListener
+	closed   bool
+}
+
+// listeners holds all active listeners by address. Servers created for the
+// same address (e.g. when rc.lua is reloaded) share the listener and the most
+// recently created server handles all requests
+var (
+	listenersLock sync.Mutex
+	listeners     = make(map[string]*sharedListener)
+)
+
+type sharedListener struct {
+	address  string
+	listener net.Listener
+	srv      *http.Server
+
+	// servers holds all servers using the listener. The last one
+	// handles incoming requests
+	servers []*Server
+}
+
+// ServeHTTP implements http.Handler and forwards the request to
+// the most recently attached server. Requests arriving while the
+// listener is closed after its last server detached are rejected
+func (sl *sharedListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	listenersLock.Lock()
+	var s *Server
+	if len(sl.servers) > 0 {
+		s = sl.servers[len(sl.servers)-1]
+	}
+	listenersLock.Unlock()
+
+	if s == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.ServeHTTP(w, r)
+}
+
+// acquireListener attaches s to the listener for address. A new listener is
+// created if there is none yet
+func acquireListener(address string, s *Server) (*sharedListener, error) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	if sl, ok := listeners[address]; ok {
+		sl.servers = append(sl.servers, s)
+		return sl, nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &sharedListener{
+		address:  address,
+		listener: listener,
+		servers:  []*Server{s},
+	}
+	sl.srv = &http.Server{
+		Handler: sl,
+	}
+
+	// listeners on random ports cannot be shared
+	if _, port, _ := net.SplitHostPort(address); port != "0" {
+		listeners[address] = sl
+	}
+
+	go func() {
+		if err := sl.srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("http: server on %s failed: %s\n", address, err.Error())
+		}
+	}()
+
+	return sl, nil
+}
+
+// releaseListener detaches s from its listener and closes the listener
+// if there are no servers left
+func releaseListener(s *Server) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	sl := s.listener
+	for i, srv := range sl.servers {
+		if srv == s {
+			sl.servers = append(sl.servers[:i], sl.servers[i+1:]...)
+			break
+		}
+	}
+
+	if len(sl.servers) > 0 {
+		return
+	}
+
+	if listeners[sl.address] == sl {
+		delete(listeners, sl.address)
+	}
+
+	// do not block the event loop
+	go sl.srv.Close()
+}
+
+// Close detaches the server from its listener. It is safe to call
+// Close multiple times
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	releaseListener(s)
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  callback.Callback
+	loop     loop.Loop
+	origin   string
+}
+
+// response holds the values returned by a lua route handler
+type response struct {
+	status  int
+	headers http.Header
+	body    string
+}
+
+// report reports an invalid response returned by the handler of the route.
+// Errors raised by the handler itself are reported by the callback
+func (r *route) report(err error) {
+	r.loop.Schedule(func(L *lua.LState) {
+		loop.ReportError(L, r.handler.Callable(), r.origin, err)
+	})
+}
+
+// match checks if the route matches method and path and returns
+// all path parameters
+func (r *route) match(method, path string) (map[string]string, bool) {
+	if r.method != "*" && r.method != method {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	parts := splitPath(path)
+
+	for i, seg := range r.segments {
+		// a trailing wildcard matches the rest of the path
+		if seg == "*" && i == len(r.segments)-1 {
+			params["*"] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = parts[i]
+			continue
+		}
+
+		if seg != parts[i] {
+			return nil, false
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		matched *route
+		params  map[string]string
+	)
+
+	s.lock.RLock()
+	for _, rt := range s.routes {
+		if p, ok := rt.match(r.Method, r.URL.Path); ok {
+			matched = rt
+			params = p
+			break
+		}
+	}
+	s.lock.RUnlock()
+
+	if matched == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the handler is executed on the event loop, we only wait for
+	// its results inside the HTTP server goroutine. If the client
+	// goes away before the handler is executed it is not run at all
+	results, err := matched.handler.FromWithResult(r.Context(), nil, func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{
+			convertRequestToTable(L, r, params, body),
+		}
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+
+	var res *response
+	if err == nil {
+		if res, err = newResponse(results.Go); err != nil {
+			matched.report(err)
+		}
+	}
+
+	if err != nil {
+		log.Printf("http: handler for %s %s failed: %s\n", r.Method, r.URL.Path, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for key, values := range res.headers {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(res.status)
+	w.Write([]byte(res.body))
+}
+
+// newServer creates a new HTTP server and starts listening on
+// the configured address
+func newServer(L *lua.LState) int {
+	opts := L.CheckTable(2)
+
+	address := ":8080"
+	addr := opts.RawGetString("address")
+	if v, ok := addr.(lua.LString); ok {
+		address = string(v)
+	} else if addr != lua.LNil {
+		L.ArgError(2, "address must be nil or a string")
+	}
+
+	s := &Server{}
+
+	listener, err := acquireListener(address, s)
+	if err != nil {
+		L.RaiseError("http: %s", err.Error())
+		return 0
+	}
+	s.listener = listener
+
+	// make sure we stop serving requests once the loop is stopped
+	loop.LGet(L).OnExit(func(*lua.LState) {
+		s.Close()
+	})
+
+	ud := L.NewUserData()
+	ud.Value = s
+	L.SetMetatable(ud, L.GetTypeMetatable(serverTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+func checkServer(L *lua.LState) *Server {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*Server); ok {
+		return s
+	}
+
+	L.ArgError(1, "expected a "+serverTypeName)
+	return nil
+}
+
+// serverRoute provides `server:route(method, pattern, handler)`. Path patterns
+// may contain parameters (`/devices/:name`) and a trailing wildcard (`/static/*`).
+// The handler is called with a request table and should return the status code,
+// a table of headers and the response body
+func serverRoute(L *lua.LState) int {
+	s := checkServer(L)
+	method := strings.ToUpper(L.CheckString(2))
+	pattern := L.CheckString(3)
+	handler := L.CheckFunction(4)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l := loop.LGet(L)
+	origin := "http:" + method + " " + pattern
+
+	s.routes = append(s.routes, &route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  callback.New(handler, l, callback.WithOrigin(origin)),
+		loop:     l,
+		origin:   origin,
+	})
+
+	return 0
+}
+
+// serverAddress returns the address the server is listening on
+func serverAddress(L *lua.LState) int {
+	s := checkServer(L)
+	L.Push(lua.LString(s.listener.listener.Addr().String()))
+	return 1
+}
+
+// serverClose stops the HTTP server
+func serverClose(L *lua.LState) int {
+	s := checkServer(L)
+	s.Close()
+
+	return 0
+}
+
+// newResponse creates a response from the values returned by a route
+// handler (status code, headers and body) after converting them to Go
+func newResponse(values []interface{}) (*response, error) {
+	// missing return values are nil
+	for len(values) < 3 {
+		values = append(values, nil)
+	}
+	status, headers, body := values[0], values[1], values[2]
+
+	res := &response{
+		status:  http.StatusOK,
+		headers: make(http.Header),
+	}
+
+	if v, ok := status.(float64); ok {
+		res.status = int(v)
+	} else if status != nil {
+		return nil, fmt.Errorf("expected the status code to be a number or nil, got %T", status)
+	}
+
+	switch h := headers.(type) {
+	case nil:
+	case map[string]interface{}:
+		for name, value := range h {
+			switch v := value.(type) {
+			case string:
+				res.headers.Add(name, v)
+			case []interface{}:
+				for _, hv := range v {
+					res.headers.Add(name, fmt.Sprint(hv))
+				}
+			default:
+				return nil, fmt.Errorf("HTTP header fields must either be strings or list of strings")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("expected headers to be a table or nil, got %T", headers)
+	}
+
+	switch b := body.(type) {
+	case nil:
+	case string:
+		res.body = b
+	case float64:
+		res.body = lua.LNumber(b).String()
+	default:
+		return nil, fmt.Errorf("expected the body to be a string, a number or nil, got %T", body)
+	}
+
+	return res, nil
+}
+
+func convertRequestToTable(L *lua.LState, r *http.Request, params map[string]string, body []byte) *lua.LTable {
+	t := L.NewTable()
+
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("url", lua.LString(r.URL.String()))
+	t.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	t.RawSetString("body", lua.LString(body))
+
+	headers := L.NewTable()
+	for key, values := range r.Header {
+		ht := L.NewTable()
+		for _, v := range values {
+			ht.Append(lua.LString(v))
+		}
+
+		headers.RawSetString(key, ht)
+	}
+	t.RawSetString("headers", headers)
+
+	query := L.NewTable()
+	for key, values := range r.URL.Query() {
+		qt := L.NewTable()
+		for _, v := range values {
+			qt.Append(lua.LString(v))
+		}
+
+		query.RawSetString(key, qt)
+	}
+	t.RawSetString("query", query)
+
+	p := L.NewTable()
+	for key, value := range params {
+		p.RawSetString(key, lua.LString(value))
+	}
+	t.RawSetString("params", p)
+
+	return t
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_RouteMatch(t *testing.T) {
+	cases := []struct {
+		method  string
+		pattern string
+		reqM    string
+		path    string
+		match   bool
+		params  map[string]string
+	}{
+		{"GET", "/hooks", "GET", "/hooks", true, nil},
+		{"GET", "/hooks", "POST", "/hooks", false, nil},
+		{"*", "/hooks", "POST", "/hooks/", true, nil},
+		{"GET", "/hooks/:name", "GET", "/hooks/alertmanager", true, map[string]string{"name": "alertmanager"}},
+		{"GET", "/hooks/:name", "GET", "/hooks", false, nil},
+		{"GET", "/hooks/:name", "GET", "/hooks/a/b", false, nil},
+		{"GET", "/static/*", "GET", "/static/css/main.css", true, map[string]string{"*": "css/main.css"}},
+	}
+
+	for idx, c := range cases {
+		r := &route{method: c.method, segments: splitPath(c.pattern)}
+		params, ok := r.match(c.reqM, c.path)
+		if ok != c.match {
+			t.Errorf("case #%d: expected match to be %v but got %v", idx, c.match, ok)
+			continue
+		}
+
+		for key, value := range c.params {
+			if params[key] != value {
+				t.Errorf("case #%d: expected parameter %s to be %q but got %q", idx, key, value, params[key])
+			}
+		}
+	}
+}
+
+func Test_ServerRoute(t *testing.T) {
+	l, _ := helper.GetTestLoop(t, Preload)
+
+	var address string
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		srv = require("envel.bindings.http.server"){
+			address = "127.0.0.1:0",
+		}
+
+		srv:route("POST", "/hooks/:name", function(req)
+			return 202, {["X-Hook"] = req.params.name}, req.body .. req.query.suffix[1]
+		end)
+
+		srv:route("GET", "/fail", function(req)
+			-- error() is replaced by the test helper
+			return req.missing.field
+		end)
+
+		srv:route("GET", "/table", function(req)
+			return 200, nil, {}
+		end)
+		`)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		srv := L.GetGlobal("srv").(*lua.LUserData).Value.(*Server)
+		address = srv.listener.listener.Addr().String()
+	})
+
+	res, err := http.Post("http://"+address+"/hooks/test?suffix=!", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("expected status code 202 but got %d", res.StatusCode)
+	}
+
+	if res.Header.Get("X-Hook") != "test" {
+		t.Errorf("expected X-Hook header to be test but got %q", res.Header.Get("X-Hook"))
+	}
+
+	if string(body) != "hello!" {
+		t.Errorf("expected body to be hello! but got %q", string(body))
+	}
+
+	res, err = http.Get("http://" + address + "/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status code 500 but got %d", res.StatusCode)
+	}
+
+	// bodies that cannot be sent are not dropped silently
+	res, err = http.Get("http://" + address + "/table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status code 500 for a table body but got %d", res.StatusCode)
+	}
+
+	res, err = http.Get("http://" + address + "/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code 404 but got %d", res.StatusCode)
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if err := L.DoString(`srv:close()`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_ListenerWithoutServer(t *testing.T) {
+	// requests may arrive while the listener is closed after its
+	// last server has been released
+	sl := &sharedListener{}
+
+	rec := httptest.NewRecorder()
+	sl.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code 503 but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,306 @@
+package loop
+
+import (
+	"errors"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const pendingTypeName = "pending"
+
+// awaitSource wraps the native yield function so errors of rejected
+// operations are raised at the await point. It returns await() and sleep()
+const awaitSource = `
+local yield, new_sleep = ...
+
+local function check(ok, ...)
+    if not ok then
+        error((...), 3)
+    end
+    return ...
+end
+
+local function await(op)
+    return check(yield(op))
+end
+
+local function sleep(seconds)
+    return await(new_sleep(seconds))
+end
+
+return await, sleep
+`
+
+// Pending represents an asynchronous operation that completes in the future.
+// Lua tasks started with `async()` can suspend until the operation finishes
+// using `await()`. Native bindings may return a Pending instead of accepting
+// a callback function.
+type Pending struct {
+	loop Loop
+
+	// the following fields may only be accessed from within the loop
+	done    bool
+	values  []lua.LValue
+	err     error
+	waiters []func(*lua.LState, []lua.LValue, error)
+}
+
+var pendingTypeAPI = map[string]lua.LGFunction{
+	"is_done": pendingIsDone,
+}
+
+// NewPending creates a new pending operation for the loop of L. The returned LUserData
+// still needs to be pushed to the Lua stack using L.Push
+func NewPending(L *lua.LState) (*lua.LUserData, *Pending) {
+	p := &Pending{
+		loop: LGet(L),
+	}
+
+	ud := L.NewUserData()
+	ud.Value = p
+	L.SetMetatable(ud, L.GetTypeMetatable(pendingTypeName))
+
+	return ud, p
+}
+
+// Resolve completes the operation. fn is executed inside the loop and should
+// return the values passed to the awaiting task. fn may be nil. Resolve is safe
+// to be called from any goroutine. Only the first call to Resolve or Reject
+// has an effect
+func (p *Pending) Resolve(fn func(*lua.LState) []lua.LValue) {
+	p.loop.Schedule(func(L *lua.LState) {
+		var values []lua.LValue
+		if fn != nil {
+			values = fn(L)
+		}
+
+		p.complete(L, values, nil)
+	})
+}
+
+// Reject completes the operation with an error. The error is raised at
+// the await point of the waiting task. Reject is safe to be called from
+// any goroutine
+func (p *Pending) Reject(err error) {
+	p.loop.Schedule(func(L *lua.LState) {
+		p.complete(L, nil, err)
+	})
+}
+
+// complete marks the operation as done and notifies all waiters. It must
+// be called from within the loop
+func (p *Pending) complete(L *lua.LState, values []lua.LValue, err error) {
+	if p.done {
+		return
+	}
+
+	p.done = true
+	p.values = values
+	p.err = err
+
+	waiters := p.waiters
+	p.waiters = nil
+
+	for _, fn := range waiters {
+		fn(L, values, err)
+	}
+}
+
+// then registers fn to be called once the operation completed. If the operation
+// is already done fn is called immediately. It must be called from within the loop
+func (p *Pending) then(L *lua.LState, fn func(*lua.LState, []lua.LValue, error)) {
+	if p.done {
+		fn(L, p.values, p.err)
+		return
+	}
+
+	p.waiters = append(p.waiters, fn)
+}
+
+// coroutine is a Lua task started via async()
+type coroutine struct {
+	loop   *loop
+	thread *lua.LState
+	fn     *lua.LFunction
+	result *Pending
+}
+
+// resume resumes the coroutine with args and waits for the next
+// operation if the coroutine yields
+func (c *coroutine) resume(L *lua.LState, args ...lua.LValue) {
+	SetJobSource(L, FunctionSource(c.fn))
+
+	// the coroutine must honor the deadline of the job that resumes it
+	if ctx := L.Context(); ctx != nil {
+		c.thread.SetContext(ctx)
+	} else {
+		c.thread.RemoveContext()
+	}
+
+	state, err, values := L.Resume(c.thread, c.fn, args...)
+
+	switch state {
+	case lua.ResumeError:
+		c.loop.reportError(FunctionSource(c.fn), "async", err)
+		c.result.complete(L, nil, err)
+
+	case lua.ResumeOK:
+		c.result.complete(L, values, nil)
+
+	case lua.ResumeYield:
+		p := checkYieldedPending(values)
+		if p == nil {
+			err := errors.New("async tasks may only yield pending operations, use await()")
+			c.loop.reportError(FunctionSource(c.fn), "async", err)
+			c.result.complete(L, nil, err)
+			return
+		}
+
+		p.then(L, func(_ *lua.LState, values []lua.LValue, err error) {
+			// resumption always goes through the loop so other tasks
+			// get a chance to run
+			c.loop.Schedule(func(L *lua.LState) {
+				if err != nil {
+					c.resume(L, lua.LFalse, lua.LString(err.Error()))
+					return
+				}
+
+				c.resume(L, append([]lua.LValue{lua.LTrue}, values...)...)
+			})
+		})
+	}
+}
+
+func checkYieldedPending(values []lua.LValue) *Pending {
+	if len(values) == 0 {
+		return nil
+	}
+
+	ud, ok := values[0].(*lua.LUserData)
+	if !ok {
+		return nil
+	}
+
+	p, _ := ud.Value.(*Pending)
+	return p
+}
+
+// openAsync adds async(), await() and sleep() to the VM
+func (l *loop) openAsync(L *lua.LState) error {
+	mt := L.NewTypeMetatable(pendingTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), pendingTypeAPI))
+
+	fn, err := L.LoadString(awaitSource)
+	if err != nil {
+		return err
+	}
+
+	L.Push(fn)
+	L.Push(L.NewFunction(l.yieldLua))
+	L.Push(L.NewFunction(l.sleepLua))
+	L.Call(2, 2)
+
+	L.SetGlobal("await", L.Get(-2))
+	L.SetGlobal("sleep", L.Get(-1))
+	L.SetGlobal("async", L.NewFunction(l.asyncLua))
+	L.Pop(2)
+
+	return nil
+}
+
+// asyncLua provides `async(fn, ...)` and starts fn as a new task. It returns
+// a pending operation that completes when fn returns
+func (l *loop) asyncLua(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	args := make([]lua.LValue, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+
+	ud, p := NewPending(L)
+	thread, _ := L.NewThread()
+
+	c := &coroutine{
+		loop:   l,
+		thread: thread,
+		fn:     fn,
+		result: p,
+	}
+
+	l.Schedule(func(L *lua.LState) {
+		c.resume(L, args...)
+	})
+
+	L.Push(ud)
+	return 1
+}
+
+// yieldLua suspends the current task until the operation passed as the first
+// argument completes. The operation is either a pending userdata or a function
+// that accepts a callback. In the later case, the first invocation of the callback
+// completes the operation
+func (l *loop) yieldLua(L *lua.LState) int {
+	if L.Parent == nil {
+		L.RaiseError("await() can only be used inside tasks started with async()")
+		return 0
+	}
+
+	op := L.Get(1)
+
+	switch v := op.(type) {
+	case *lua.LUserData:
+		if _, ok := v.Value.(*Pending); !ok {
+			L.ArgError(1, "expected a pending operation or a function")
+		}
+
+		return L.Yield(v)
+
+	case *lua.LFunction:
+		ud, p := NewPending(L)
+		resolve := L.NewFunction(func(L *lua.LState) int {
+			values := make([]lua.LValue, 0, L.GetTop())
+			for i := 1; i <= L.GetTop(); i++ {
+				values = append(values, L.Get(i))
+			}
+
+			p.complete(L, values, nil)
+			return 0
+		})
+
+		L.Push(v)
+		L.Push(resolve)
+		L.Call(1, 0)
+
+		return L.Yield(ud)
+	}
+
+	L.ArgError(1, "expected a pending operation or a function")
+	return 0
+}
+
+// sleepLua returns a pending operation that completes after the number
+// of seconds passed as the first argument
+func (l *loop) sleepLua(L *lua.LState) int {
+	seconds := L.CheckNumber(1)
+	ud, p := NewPending(L)
+
+	l.ScheduleAfter(time.Duration(float64(seconds)*float64(time.Second)), func(L *lua.LState) {
+		p.complete(L, nil, nil)
+	})
+
+	L.Push(ud)
+	return 1
+}
+
+func pendingIsDone(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	p, ok := ud.Value.(*Pending)
+	if !ok {
+		L.ArgError(1, "expected a pending operation")
+		return 0
+	}
+
+	L.Push(lua.LBool(p.done))
+	return 1
+}
@@ -0,0 +1,134 @@
+package loop
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ErrorEvent is emitted for each failed job or callback with the error
+// message, source, traceback and origin
+const ErrorEvent = "envel::error"
+
+// JobError describes a job that failed with a Lua error or a panic
+type JobError struct {
+	// Source describes the origin of the failed job (see SetJobSource)
+	Source string
+
+	// Origin describes the binding that triggered the job (e.g. an MQTT
+	// topic, a signal name or a timer). It may be empty
+	Origin string
+
+	// Err is the error returned by Lua or the recovered panic
+	Err error
+
+	// Stack holds the Lua traceback or the Go stack trace in case of a panic
+	Stack string
+}
+
+// Error implements the error interface
+func (e *JobError) Error() string {
+	if e.Origin != "" {
+		return fmt.Sprintf("job from %s (%s) failed: %s", e.Source, e.Origin, e.Message())
+	}
+
+	return fmt.Sprintf("job from %s failed: %s", e.Source, e.Message())
+}
+
+// Message returns the error message without the traceback
+func (e *JobError) Message() string {
+	if apiErr, ok := e.Err.(*lua.ApiError); ok && apiErr.Object != nil {
+		return apiErr.Object.String()
+	}
+
+	return e.Err.Error()
+}
+
+// ReportError reports an error returned by the Lua function fn that has been
+// called in protected mode outside of the job itself (e.g. a callback). The
+// error is reported the same way as failed jobs are and emitted as an
+// envel::error event. origin describes the binding that invoked fn
+func ReportError(L *lua.LState, fn *lua.LFunction, origin string, err error) {
+	l, ok := LGet(L).(*loop)
+	if !ok {
+		log.Printf("error in %s: %s\n", FunctionSource(fn), err.Error())
+		return
+	}
+
+	l.reportError(FunctionSource(fn), origin, err)
+}
+
+// MarkErrorDelivery marks the job currently executed by the loop of L as the
+// delivery of an ErrorEvent. Errors of the job are reported but not emitted
+// again as a failing error handler would otherwise be called forever
+func MarkErrorDelivery(L *lua.LState) {
+	if l, ok := LGet(L).(*loop); ok {
+		l.errorDelivery = true
+	}
+}
+
+// execute runs task in protected mode so neither Lua errors nor panics
+// can take down the loop
+func (l *loop) execute(task Task) {
+	var goStack string
+
+	err := l.vm.GPCall(func(L *lua.LState) int {
+		defer func() {
+			if r := recover(); r != nil {
+				// Lua errors already carry a traceback
+				if _, ok := r.(*lua.ApiError); !ok {
+					goStack = string(debug.Stack())
+				}
+				panic(r)
+			}
+		}()
+
+		task(L)
+		return 0
+	}, lua.LNil)
+
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok && goStack != "" {
+			apiErr.StackTrace = goStack
+		}
+
+		l.reportError(l.source, "", err)
+	}
+}
+
+// reportError reports a failed job to the OnError hook and emits an
+// ErrorEvent
+func (l *loop) reportError(source, origin string, err error) {
+	if source == "" {
+		source = "<unknown>"
+	}
+
+	jobErr := &JobError{
+		Source: source,
+		Origin: origin,
+		Err:    err,
+	}
+
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		jobErr.Stack = apiErr.StackTrace
+	}
+
+	jobsFailed.With(prometheus.Labels{"loop": "default", "source": source}).Inc()
+
+	if l.onError != nil {
+		l.onError(jobErr)
+	} else {
+		log.Printf("%s\n%s\n", jobErr.Error(), jobErr.Stack)
+	}
+
+	// errors of envel::error handlers are not emitted again as
+	// a failing handler would otherwise loop forever
+	if l.errorDelivery {
+		return
+	}
+
+	l.emit(ErrorEvent, lua.LString(jobErr.Message()), lua.LString(source), lua.LString(jobErr.Stack), lua.LString(origin))
+}
@@ -0,0 +1,40 @@
+package loop
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// goroutineID returns the ID of the calling goroutine. Go does not expose
+// it so it is parsed from the header of the stack trace ("goroutine 1 [...")
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// own marks the calling goroutine as the one executing the VM of the loop
+func (l *loop) own() {
+	atomic.StoreUint64(&l.owner, goroutineID())
+}
+
+// release clears the goroutine executing the VM of the loop
+func (l *loop) release() {
+	atomic.StoreUint64(&l.owner, 0)
+}
+
+// inLoop returns true if the caller executes on the goroutine that owns
+// the VM of the loop (e.g. from within a task or an exit handler)
+func (l *loop) inLoop() bool {
+	owner := atomic.LoadUint64(&l.owner)
+	return owner != 0 && owner == goroutineID()
+}
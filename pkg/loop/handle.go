@@ -0,0 +1,220 @@
+package loop
+
+import (
+	"errors"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const handleTypeName = "task_handle"
+
+// ErrTaskCancelled is returned by Handle.Err if the task has been cancelled
+// before it has been executed
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// ErrTaskDropped is returned by Handle.Err if the task has been removed from
+// the queue without being executed (e.g. because the loop has been stopped or
+// due to the overflow policy of the queue)
+var ErrTaskDropped = errors.New("task dropped")
+
+// Handle represents a task scheduled on the loop
+type Handle interface {
+	// Cancel removes the task from the loop if it has not been started yet.
+	// It returns true if the task has been cancelled
+	Cancel() bool
+
+	// Done returns a channel that is closed once the task has been executed,
+	// cancelled or dropped
+	Done() <-chan struct{}
+
+	// Err returns the reason the task has not been executed. It returns nil
+	// if the task has been executed or is still pending
+	Err() error
+
+	// Wait waits for the task to finish and returns Err()
+	Wait() error
+
+	// OnDone registers fn to be called once the task has been executed,
+	// cancelled or dropped. If the task is already done fn is called
+	// immediately. fn may be called on the loop and must not block
+	OnDone(fn func())
+}
+
+const (
+	taskPending = iota
+	taskRunning
+	taskFinished
+)
+
+// handle implements the Handle interface
+type handle struct {
+	lock   sync.Mutex
+	state  int
+	err    error
+	done   chan struct{}
+	onDone []func()
+}
+
+func newHandle() *handle {
+	return &handle{
+		done: make(chan struct{}),
+	}
+}
+
+// wrap returns a task that executes task only if the handle has not been
+// cancelled and marks the handle as finished afterwards
+func (h *handle) wrap(task Task) Task {
+	return func(L *lua.LState) {
+		if !h.start() {
+			return
+		}
+		defer h.finish(nil)
+
+		task(L)
+	}
+}
+
+// start marks the handle as running. It returns false if the
+// handle has already been cancelled
+func (h *handle) start() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.state != taskPending {
+		return false
+	}
+
+	h.state = taskRunning
+	return true
+}
+
+// finish marks the handle as finished with err. It is a no-op
+// if the handle is already finished
+func (h *handle) finish(err error) {
+	h.lock.Lock()
+	if h.state == taskFinished {
+		h.lock.Unlock()
+		return
+	}
+
+	onDone := h.finishLocked(err)
+	h.lock.Unlock()
+
+	for _, fn := range onDone {
+		fn()
+	}
+}
+
+// finishLocked marks the handle as finished and returns the functions
+// registered using OnDone. The caller must hold h.lock and call them
+// once the lock has been released
+func (h *handle) finishLocked(err error) []func() {
+	h.state = taskFinished
+	h.err = err
+	close(h.done)
+
+	onDone := h.onDone
+	h.onDone = nil
+
+	return onDone
+}
+
+// Cancel implements Handle.Cancel
+func (h *handle) Cancel() bool {
+	h.lock.Lock()
+	if h.state != taskPending {
+		h.lock.Unlock()
+		return false
+	}
+
+	onDone := h.finishLocked(ErrTaskCancelled)
+	h.lock.Unlock()
+
+	for _, fn := range onDone {
+		fn()
+	}
+
+	return true
+}
+
+// Done implements Handle.Done
+func (h *handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err implements Handle.Err
+func (h *handle) Err() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.err
+}
+
+// Wait implements Handle.Wait
+func (h *handle) Wait() error {
+	<-h.done
+	return h.Err()
+}
+
+// OnDone implements Handle.OnDone
+func (h *handle) OnDone(fn func()) {
+	h.lock.Lock()
+	if h.state != taskFinished {
+		h.onDone = append(h.onDone, fn)
+		h.lock.Unlock()
+		return
+	}
+	h.lock.Unlock()
+
+	fn()
+}
+
+var handleTypeAPI = map[string]lua.LGFunction{
+	"cancel":  handleCancel,
+	"is_done": handleIsDone,
+}
+
+// NewHandleUserData returns a LUserData for h that can be passed to Lua.
+// The userdata provides `cancel()` and `is_done()`
+func NewHandleUserData(L *lua.LState, h Handle) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = h
+	L.SetMetatable(ud, L.GetTypeMetatable(handleTypeName))
+
+	return ud
+}
+
+func openHandle(L *lua.LState) {
+	mt := L.NewTypeMetatable(handleTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), handleTypeAPI))
+}
+
+func checkHandle(L *lua.LState) Handle {
+	ud := L.CheckUserData(1)
+	if h, ok := ud.Value.(Handle); ok {
+		return h
+	}
+
+	L.ArgError(1, "expected a task handle")
+	return nil
+}
+
+func handleCancel(L *lua.LState) int {
+	h := checkHandle(L)
+	L.Push(lua.LBool(h.Cancel()))
+	return 1
+}
+
+func handleIsDone(L *lua.LState) int {
+	h := checkHandle(L)
+
+	select {
+	case <-h.Done():
+		L.Push(lua.LTrue)
+	default:
+		L.Push(lua.LFalse)
+	}
+
+	return 1
+}
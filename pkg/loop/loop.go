@@ -2,7 +2,10 @@ package loop
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	lua "github.com/yuin/gopher-lua"
@@ -16,36 +19,114 @@ type Loop interface {
 	// Start starts the loop
 	Start(context.Context) error
 
-	// Schedule a new task to be executed inside the loop
-	Schedule(Task)
+	// Schedule a new task to be executed inside the loop. The returned
+	// handle can be used to cancel the task
+	Schedule(Task) Handle
+
+	// ScheduleWithPriority schedules a new task in the lane for the given
+	// priority
+	ScheduleWithPriority(Priority, Task) Handle
+
+	// ScheduleKey schedules a new task identified by key. If the loop
+	// queue uses PolicyCoalesce, a queued task with the same key is
+	// replaced
+	ScheduleKey(string, Task) Handle
+
+	// ScheduleKeyWithPriority works like ScheduleKey but queues the task
+	// in the lane for the given priority
+	ScheduleKeyWithPriority(Priority, string, Task) Handle
 
 	// ScheduleAndWait schedules a task on the loop and waits for it to finish
 	ScheduleAndWait(Task)
 
+	// ScheduleAt schedules a task to be executed at the given time
+	ScheduleAt(time.Time, Task) Handle
+
+	// ScheduleAtWithPriority schedules a task to be executed at the given
+	// time in the lane for the given priority
+	ScheduleAtWithPriority(time.Time, Priority, Task) Handle
+
+	// ScheduleAfter schedules a task to be executed after the given duration
+	ScheduleAfter(time.Duration, Task) Handle
+
+	// OnExit schedules a task to be executed when the loop is stopped
+	OnExit(Task)
+
 	// Stop the loop
 	Stop()
 
 	// Wait for the loop to finish
 	Wait()
+
+	// OnEvent registers a handler for loop events (e.g. loop::job_timeout)
+	OnEvent(EventHandler)
+
+	// State returns the VM of the loop if the caller executes on the loop
+	// (e.g. from within a task) and nil otherwise
+	State() *lua.LState
 }
 
+// EventHandler is called for each event emitted by the loop. It is always
+// invoked from within the loop
+type EventHandler func(name string, args ...lua.LValue)
+
 // Options used when creating a new event loop
 type Options struct {
 	// InitVM is called with the new lua State before the event loop is initialized
 	InitVM func(*lua.LState) error
+
+	// JobTimeout is the maximum duration a single job may run. Jobs exceeding
+	// the timeout are interrupted and a loop::job_timeout event is emitted.
+	// Note that only Lua code can be interrupted. A value of zero disables
+	// the deadline
+	JobTimeout time.Duration
+
+	// OnError is called whenever a job fails with a Lua error or a panic.
+	// If nil, errors are logged
+	OnError func(*JobError)
+
+	// Queue configures the capacity and overflow policy of the job
+	// queue of each priority lane. Lanes are unbounded by default
+	Queue QueueOptions
 }
 
 // loop is the actual implementation of the Loop interface
 type loop struct {
+	// owner is the ID of the goroutine executing the VM (see own). It
+	// is accessed atomically and must stay 64-bit aligned
+	owner uint64
+
 	vm *lua.LState
 
-	queue *Queue
+	// lanes holds a job queue for each priority
+	lanes [numPriorities]*Queue
+
+	// sinceLow counts the jobs executed while the low priority
+	// lane is waiting
+	sinceLow int
 
 	exitQueue *Queue
 
+	// timers holds all tasks scheduled for a later time
+	timers *timers
+
 	wg sync.WaitGroup
 
-	running bool
+	stopping bool
+
+	jobTimeout time.Duration
+
+	onError func(*JobError)
+
+	// source describes the origin of the currently executed job
+	source string
+
+	// errorDelivery is set if the currently executed job delivers an
+	// ErrorEvent (see MarkErrorDelivery)
+	errorDelivery bool
+
+	eventLock sync.RWMutex
+	events    []EventHandler
 }
 
 // LGet returns the current event loop from the given VM
@@ -70,10 +151,19 @@ func LGet(state *lua.LState) Loop {
 func New(opts *Options) (Loop, error) {
 	vm := lua.NewState()
 
+	var queueOpts QueueOptions
+	if opts != nil {
+		queueOpts = opts.Queue
+	}
+
 	l := &loop{
 		vm:        vm,
-		queue:     NewQueue("default", "jobs"),
 		exitQueue: NewQueue("default", "exit"),
+		timers:    newTimers(),
+	}
+
+	for p := range l.lanes {
+		l.lanes[p] = NewBoundedQueue("default", Priority(p).String(), queueOpts)
 	}
 
 	ud := vm.NewUserData()
@@ -83,9 +173,26 @@ func New(opts *Options) (Loop, error) {
 	vm.SetGlobal("__schedule", vm.NewFunction(l.scheduleLua))
 	vm.SetGlobal("on_exit", vm.NewFunction(l.scheduleLuaOnExit))
 
+	openHandle(vm)
+
+	if err := l.openAsync(vm); err != nil {
+		return nil, err
+	}
+
 	if opts != nil {
+		l.jobTimeout = opts.JobTimeout
+		l.onError = opts.OnError
+
 		if opts.InitVM != nil {
+			// the init script executes on the VM so it must be
+			// treated like a job of the loop
+			l.own()
+			defer l.release()
+
 			if err := opts.InitVM(vm); err != nil {
+				// release everything the script has already
+				// acquired (e.g. timers or listeners)
+				l.shutdown()
 				return nil, err
 			}
 		}
@@ -102,61 +209,131 @@ func (l *loop) Start(ctx context.Context) error {
 	return nil
 }
 
+// scheduleLua provides `__schedule(fn, [priority])` and schedules fn in the
+// lane for priority ("high", "normal" or "low"). It returns a handle that
+// allows to cancel fn using `handle:cancel()`
 func (l *loop) scheduleLua(state *lua.LState) int {
 	fn := state.CheckFunction(1)
-
-	l.Schedule(func(state *lua.LState) {
-		state.CallByParam(lua.P{
-			Fn:   fn,
-			NRet: 0,
-		})
+	priority := CheckPriority(state, 2)
+
+	h := l.ScheduleWithPriority(priority, func(state *lua.LState) {
+		source := FunctionSource(fn)
+		SetJobSource(state, source)
+
+		if err := state.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    0,
+			Protect: true,
+		}); err != nil {
+			l.reportError(source, "__schedule", err)
+		}
 	})
 
-	return 0
+	state.Push(NewHandleUserData(state, h))
+	return 1
 }
 
 func (l *loop) scheduleLuaOnExit(state *lua.LState) int {
 	fn := state.CheckFunction(1)
 
 	l.exitQueue.Push(func(state *lua.LState) {
-		state.CallByParam(lua.P{
-			Fn:   fn,
-			NRet: 0,
-		})
+		source := FunctionSource(fn)
+		SetJobSource(state, source)
+
+		if err := state.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    0,
+			Protect: true,
+		}); err != nil {
+			l.reportError(source, "on_exit", err)
+		}
 	})
 
 	return 0
 }
 
-// Schedule schedules a task to be executed on the loop
-func (l *loop) Schedule(task Task) {
+// Schedule schedules a task to be executed on the loop. Tasks scheduled
+// after the loop has been stopped are dropped
+func (l *loop) Schedule(task Task) Handle {
+	return l.schedule(PriorityNormal, "", task, false)
+}
+
+// ScheduleWithPriority schedules a task in the lane for priority
+func (l *loop) ScheduleWithPriority(priority Priority, task Task) Handle {
+	return l.schedule(priority, "", task, false)
+}
+
+// ScheduleKey schedules a task identified by key. See Loop.ScheduleKey
+func (l *loop) ScheduleKey(key string, task Task) Handle {
+	return l.schedule(PriorityNormal, key, task, false)
+}
+
+// ScheduleKeyWithPriority schedules a task identified by key in the lane
+// for priority. See Loop.ScheduleKey
+func (l *loop) ScheduleKeyWithPriority(priority Priority, key string, task Task) Handle {
+	return l.schedule(priority, key, task, false)
+}
+
+// schedule pushes task to the job queue of priority. If force is true, the
+// capacity of the queue is ignored
+func (l *loop) schedule(priority Priority, key string, task Task, force bool) *handle {
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityNormal
+	}
+
+	h := newHandle()
+	l.push(priority, key, h, task, force)
+
+	return h
+}
+
+// push queues task in the lane for priority and marks h as dropped if
+// the lane denies the task
+func (l *loop) push(priority Priority, key string, h *handle, task Task, force bool) {
 	l.wg.Add(1)
 
-	l.queue.Push(func(L *lua.LState) {
-		defer l.wg.Done()
-		task(L)
-	})
+	// only the loop frees room in its lanes so it must never wait for
+	// it. Tasks pushed from within the loop ignore the capacity instead
+	lane := l.lanes[priority]
+	if !force && lane.opts.Policy == PolicyBlock && lane.opts.Capacity > 0 && l.inLoop() {
+		force = true
+	}
+
+	n := &node{
+		data: h.wrap(task),
+		key:  key,
+		onDrop: func() {
+			h.finish(ErrTaskDropped)
+			l.wg.Done()
+		},
+	}
+
+	if err := lane.push(n, force); err != nil {
+		h.finish(ErrTaskDropped)
+		l.wg.Done()
+	}
 }
 
-// ScheduleAndWait schedules a task and waits for it to be executed
+// ScheduleAndWait schedules a task and waits for it to be executed. It
+// returns immediately if the loop has already been stopped or the task
+// has been dropped
 func (l *loop) ScheduleAndWait(task Task) {
-	ch := make(chan bool)
-
-	l.Schedule(func(vm *lua.LState) {
-		defer func() {
-			ch <- true
-		}()
-		task(vm)
-	})
+	l.Schedule(task).Wait()
+}
 
-	<-ch
+// OnExit schedules task to be executed when the loop is stopped
+func (l *loop) OnExit(task Task) {
+	l.exitQueue.Push(task)
 }
 
-// Stop asks the loop to stop
+// Stop asks the loop to stop. The loop stops as soon as all lanes
+// are empty
 func (l *loop) Stop() {
-	l.Schedule(func(_ *lua.LState) {
-		l.running = false
-	})
+	// stopping the loop must never be dropped due to the
+	// queue capacity
+	l.schedule(PriorityNormal, "", func(_ *lua.LState) {
+		l.stopping = true
+	}, true)
 }
 
 // Wait waits for the loop to stop
@@ -164,22 +341,67 @@ func (l *loop) Wait() {
 	l.wg.Wait()
 }
 
+// OnEvent registers fn to be called for each loop event
+func (l *loop) OnEvent(fn EventHandler) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+
+	l.events = append(l.events, fn)
+}
+
+// State implements Loop.State
+func (l *loop) State() *lua.LState {
+	if l.inLoop() {
+		return l.vm
+	}
+
+	return nil
+}
+
+// emit emits a loop event to all registered handlers
+func (l *loop) emit(name string, args ...lua.LValue) {
+	l.eventLock.RLock()
+	defer l.eventLock.RUnlock()
+
+	for _, fn := range l.events {
+		fn(name, args...)
+	}
+}
+
 func (l *loop) run(ctx context.Context) {
 	defer l.wg.Done()
-	l.running = true
 
-	for l.running {
-		job, err := l.queue.PopWait(ctx)
+	l.own()
+
+	for !l.stopping || l.pending() > 0 {
+		n, err := l.next(ctx)
 		if err != nil {
 			break
 		}
 
 		if ctx.Err() != nil {
-			l.running = false
+			// the task has already been removed from its lane so
+			// it must be dropped like all other pending tasks
+			n.onDrop()
 			break
 		}
 
-		l.runJob(job)
+		l.runJob(n.data)
+		l.wg.Done()
+	}
+
+	l.shutdown()
+}
+
+// shutdown drops all pending jobs, executes the exit queue and closes
+// the VM
+func (l *loop) shutdown() {
+	// deny any new jobs and drop everything that has been
+	// scheduled after the loop has been stopped
+	l.timers.stop()
+	for _, q := range l.lanes {
+		q.Block()
+		q.Drain()
 	}
 
 	for {
@@ -190,6 +412,9 @@ func (l *loop) run(ctx context.Context) {
 
 		l.runJob(item)
 	}
+
+	l.exitQueue.Block()
+	l.vm.Close()
 }
 
 func (l *loop) runJob(task Task) {
@@ -198,5 +423,50 @@ func (l *loop) runJob(task Task) {
 	}).Observe))
 	defer timer.ObserveDuration()
 
-	task(l.vm)
+	l.source = ""
+	l.errorDelivery = false
+
+	if l.jobTimeout <= 0 {
+		l.execute(task)
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), l.jobTimeout)
+	defer cancel()
+
+	l.vm.SetContext(ctx)
+	defer l.vm.RemoveContext()
+
+	l.execute(task)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		source := l.source
+		if source == "" {
+			source = "<unknown>"
+		}
+
+		log.Printf("job from %s exceeded the deadline of %s and has been interrupted\n", source, l.jobTimeout)
+		jobTimeouts.With(prometheus.Labels{"loop": "default"}).Inc()
+
+		l.emit("loop::job_timeout", lua.LString(source), lua.LNumber(time.Since(start).Seconds()))
+	}
+}
+
+// SetJobSource annotates the job that is currently executed by the loop of L
+// with a human readable description of its origin (e.g. the location of a Lua
+// callback). The source is used when reporting jobs that exceeded their deadline
+func SetJobSource(L *lua.LState, source string) {
+	if l, ok := LGet(L).(*loop); ok {
+		l.source = source
+	}
+}
+
+// FunctionSource returns the source location of fn in the format "source:line"
+func FunctionSource(fn *lua.LFunction) string {
+	if fn == nil || fn.IsG || fn.Proto == nil {
+		return "<native>"
+	}
+
+	return fmt.Sprintf("%s:%d", fn.Proto.SourceName, fn.Proto.LineDefined)
 }
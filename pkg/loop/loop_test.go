@@ -2,7 +2,10 @@ package loop
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -82,3 +85,526 @@ func Test_LoopAccess(t *testing.T) {
 		}
 	})
 }
+
+func Test_AsyncAwait(t *testing.T) {
+	loop, err := New(nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	loop.Start(context.Background())
+
+	done := make(chan struct{})
+
+	loop.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("done", L.NewFunction(func(L *lua.LState) int {
+			close(done)
+			return 0
+		}))
+
+		L.SetGlobal("later", L.NewFunction(func(L *lua.LState) int {
+			v := L.CheckString(1)
+			ud, p := NewPending(L)
+			go p.Resolve(func(L *lua.LState) []lua.LValue {
+				return []lua.LValue{lua.LString(v)}
+			})
+			L.Push(ud)
+			return 1
+		}))
+
+		err := L.DoString(`
+		order = {}
+
+		async(function()
+			table.insert(order, "start")
+			sleep(0.01)
+			table.insert(order, "slept")
+
+			local v = await(later("pending"))
+			table.insert(order, v)
+
+			local a, b = await(function(cb) cb("callback", 2) end)
+			table.insert(order, a..b)
+
+			done()
+		end)
+
+		table.insert(order, "main")
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the async task")
+	}
+
+	loop.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local expected = {"main", "start", "slept", "pending", "callback2"}
+		for i, v in ipairs(expected) do
+			if order[i] ~= v then
+				error("unexpected order at "..i..": "..tostring(order[i]))
+			end
+		end
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	loop.Stop()
+	loop.Wait()
+}
+
+func Test_AsyncAwaitError(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	l.Start(context.Background())
+
+	var task *Pending
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		L.SetGlobal("fail", L.NewFunction(func(L *lua.LState) int {
+			ud, p := NewPending(L)
+			p.Reject(errors.New("boom"))
+			L.Push(ud)
+			return 1
+		}))
+
+		err := L.DoString(`
+		reached = false
+		task = async(function()
+			await(fail())
+			reached = true
+		end)
+
+		-- await is not allowed outside of tasks
+		ok = pcall(await, fail())
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+
+		task = L.GetGlobal("task").(*lua.LUserData).Value.(*Pending)
+		if L.GetGlobal("ok") != lua.LFalse {
+			t.Errorf("expected await() to fail outside of async tasks")
+		}
+	})
+
+	// give the task some time to run
+	time.Sleep(10 * time.Millisecond)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if !task.done || task.err == nil {
+			t.Fatalf("expected task to fail")
+		}
+
+		if !strings.Contains(task.err.Error(), "boom") {
+			t.Errorf("expected error to contain boom but got %s", task.err.Error())
+		}
+
+		if L.GetGlobal("reached") != lua.LFalse {
+			t.Errorf("expected task to stop at the await point")
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopJobTimeout(t *testing.T) {
+	l, err := New(&Options{
+		JobTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	events := make(chan string, 1)
+	l.OnEvent(func(name string, args ...lua.LValue) {
+		if name == "loop::job_timeout" {
+			events <- args[0].String()
+		}
+	})
+
+	l.Start(context.Background())
+
+	var callErr error
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if err := L.DoString(`function endless() while true do end end`); err != nil {
+			t.Fatal(err)
+		}
+
+		fn := L.GetGlobal("endless").(*lua.LFunction)
+		SetJobSource(L, FunctionSource(fn))
+
+		callErr = L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    0,
+			Protect: true,
+		})
+	})
+
+	if callErr == nil {
+		t.Errorf("expected the endless job to be interrupted")
+	}
+
+	select {
+	case source := <-events:
+		if source != "<string>:1" {
+			t.Errorf("expected source to be <string>:1 but got %s", source)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected a loop::job_timeout event")
+	}
+
+	// the loop must still be usable
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if err := L.DoString(`x = 1`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopErrorRecovery(t *testing.T) {
+	errs := make(chan *JobError, 2)
+
+	l, err := New(&Options{
+		OnError: func(err *JobError) {
+			errs <- err
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	l.Start(context.Background())
+
+	l.Schedule(func(L *lua.LState) {
+		SetJobSource(L, "native-binding")
+		panic("something went wrong")
+	})
+
+	select {
+	case err := <-errs:
+		if err.Source != "native-binding" {
+			t.Errorf("expected source to be native-binding but got %s", err.Source)
+		}
+
+		if !strings.Contains(err.Err.Error(), "something went wrong") {
+			t.Errorf("unexpected error: %s", err.Err.Error())
+		}
+
+		if err.Stack == "" {
+			t.Errorf("expected a stack trace")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the panic to be reported")
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if err := L.DoString(`
+		__schedule(function()
+			local x = nil
+			x()
+		end)
+		`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case err := <-errs:
+		if err.Source != "<string>:2" {
+			t.Errorf("expected source to be <string>:2 but got %s", err.Source)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the Lua error to be reported")
+	}
+
+	// the loop must still be usable
+	l.ScheduleAndWait(func(L *lua.LState) {})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopPriority(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	add := func(p Priority, name string) {
+		l.ScheduleWithPriority(p, func(*lua.LState) {
+			order = append(order, name)
+		})
+	}
+
+	// queue everything before the loop is started
+	add(PriorityLow, "low")
+	add(PriorityNormal, "normal")
+	add(PriorityHigh, "high")
+
+	l.Start(context.Background())
+	l.Stop()
+	l.Wait()
+
+	if strings.Join(order, ",") != "high,normal,low" {
+		t.Errorf("unexpected execution order: %v", order)
+	}
+}
+
+func Test_LoopPriorityStarvation(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lowAt := -1
+	count := 0
+
+	l.ScheduleWithPriority(PriorityLow, func(*lua.LState) {
+		lowAt = count
+	})
+
+	for i := 0; i < 2*maxLowPriorityDelay; i++ {
+		l.Schedule(func(*lua.LState) {
+			count++
+		})
+	}
+
+	l.Start(context.Background())
+	l.Stop()
+	l.Wait()
+
+	if lowAt != maxLowPriorityDelay {
+		t.Errorf("expected the low priority task to run after %d tasks but ran after %d", maxLowPriorityDelay, lowAt)
+	}
+}
+
+func Test_LoopSchedulePriorityLua(t *testing.T) {
+	l, err := New(&Options{
+		InitVM: func(L *lua.LState) error {
+			return L.DoString(`
+			order = {}
+			__schedule(function() table.insert(order, "low") end, "low")
+			__schedule(function() table.insert(order, "high") end, "high")
+			`)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Start(context.Background())
+
+	// the check is queued in the low lane after the Lua tasks
+	ch := make(chan string, 1)
+	l.ScheduleWithPriority(PriorityLow, func(L *lua.LState) {
+		if err := L.DoString(`result = table.concat(order, ",")`); err != nil {
+			t.Error(err)
+		}
+		ch <- L.GetGlobal("result").String()
+	})
+	order := <-ch
+
+	l.Stop()
+	l.Wait()
+
+	if order != "high,low" {
+		t.Errorf("unexpected execution order: %s", order)
+	}
+}
+
+func Test_LoopCancel(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executed := false
+	h := l.Schedule(func(*lua.LState) {
+		executed = true
+	})
+
+	if !h.Cancel() {
+		t.Errorf("expected a pending task to be cancelable")
+	}
+
+	select {
+	case <-h.Done():
+	default:
+		t.Errorf("expected Done() to be closed after Cancel()")
+	}
+
+	if h.Err() != ErrTaskCancelled {
+		t.Errorf("expected ErrTaskCancelled but got %v", h.Err())
+	}
+
+	l.Start(context.Background())
+
+	h = l.Schedule(func(*lua.LState) {})
+	if err := h.Wait(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if h.Cancel() {
+		t.Errorf("expected an executed task to not be cancelable")
+	}
+
+	l.Stop()
+	l.Wait()
+
+	if executed {
+		t.Errorf("cancelled task has been executed")
+	}
+
+	// tasks scheduled after the loop has been stopped are dropped
+	if err := l.Schedule(func(*lua.LState) {}).Wait(); err != ErrTaskDropped {
+		t.Errorf("expected ErrTaskDropped but got %v", err)
+	}
+}
+
+func Test_LoopContextCancel(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the second task is popped after the context has been cancelled
+	// and must be finished instead of being lost
+	l.Schedule(func(*lua.LState) {
+		cancel()
+	})
+	h := l.Schedule(func(*lua.LState) {
+		t.Errorf("expected the task to be dropped")
+	})
+
+	l.Start(ctx)
+
+	select {
+	case <-h.Done():
+		if h.Err() != ErrTaskDropped {
+			t.Errorf("expected ErrTaskDropped but got %v", h.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handle to be finished")
+	}
+
+	l.Wait()
+}
+
+func Test_LoopCancelLua(t *testing.T) {
+	l, err := New(&Options{
+		InitVM: func(L *lua.LState) error {
+			return L.DoString(`
+			called = false
+			local h = __schedule(function() called = true end)
+			cancelled = h:cancel()
+			is_done = h:is_done()
+			`)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Start(context.Background())
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if L.GetGlobal("cancelled") != lua.LTrue || L.GetGlobal("is_done") != lua.LTrue {
+			t.Errorf("expected the handle to be cancelled")
+		}
+
+		if L.GetGlobal("called") != lua.LFalse {
+			t.Errorf("expected the cancelled function to not be called")
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopScheduleAfter(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Start(context.Background())
+
+	var order []string
+	start := time.Now()
+
+	second := l.ScheduleAfter(40*time.Millisecond, func(*lua.LState) {
+		order = append(order, "second")
+	})
+	l.ScheduleAfter(20*time.Millisecond, func(*lua.LState) {
+		order = append(order, "first")
+	})
+	cancelled := l.ScheduleAfter(30*time.Millisecond, func(*lua.LState) {
+		order = append(order, "cancelled")
+	})
+	cancelled.Cancel()
+
+	if err := second.Wait(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("task executed too early after %s", d)
+	}
+
+	// pending timers do not prevent the loop from stopping
+	pending := l.ScheduleAfter(time.Hour, func(*lua.LState) {})
+
+	l.Stop()
+	l.Wait()
+
+	if strings.Join(order, ",") != "first,second" {
+		t.Errorf("unexpected execution order: %v", order)
+	}
+
+	if pending.Err() != ErrTaskDropped {
+		t.Errorf("expected pending timers to be dropped but got %v", pending.Err())
+	}
+}
+
+func Test_LoopScheduleAfterCancel(t *testing.T) {
+	l, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Start(context.Background())
+
+	// cancelled timers must not stay in the heap until their deadline
+	for i := 0; i < 100; i++ {
+		l.ScheduleAfter(time.Hour, func(*lua.LState) {}).Cancel()
+	}
+
+	timers := l.(*loop).timers
+	timers.lock.Lock()
+	n := len(timers.heap)
+	timers.lock.Unlock()
+
+	if n != 0 {
+		t.Errorf("expected cancelled timers to be removed but %d are pending", n)
+	}
+
+	l.Stop()
+	l.Wait()
+}
@@ -20,6 +20,26 @@ var (
 		Help: "Current number of queued jobs",
 	}, []string{"loop", "queue"})
 
+	droppedJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jobs_dropped_total",
+		Help: "Total number of jobs dropped because the queue was full",
+	}, []string{"loop", "queue", "policy"})
+
+	pendingTimers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "timers_pending",
+		Help: "Current number of tasks waiting for their deadline",
+	}, []string{"loop"})
+
+	jobTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_timeouts_total",
+		Help: "Total number of jobs interrupted because they exceeded their deadline",
+	}, []string{"loop"})
+
+	jobsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jobs_failed_total",
+		Help: "Total number of jobs that failed with an error or a panic",
+	}, []string{"loop", "source"})
+
 	jobExecDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "job_exec_duration",
@@ -31,5 +51,5 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(totalJobs, queuedJobs, jobExecDuration, queueIdle)
+	prometheus.MustRegister(totalJobs, queuedJobs, jobExecDuration, queueIdle, droppedJobs, pendingTimers, jobTimeouts, jobsFailed)
 }
@@ -0,0 +1,151 @@
+package loop
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Priority selects the lane a task is queued in. Tasks in the high lane are
+// always executed before tasks in the normal lane which are executed before
+// tasks in the low lane
+type Priority int
+
+const (
+	// PriorityNormal is the default priority of tasks
+	PriorityNormal Priority = iota
+
+	// PriorityHigh should be used for time critical tasks like
+	// safety actions or shutdown handlers
+	PriorityHigh
+
+	// PriorityLow should be used for tasks that may be delayed,
+	// like processing bulk sensor updates
+	PriorityLow
+
+	numPriorities
+)
+
+// maxLowPriorityDelay is the maximum number of high and normal priority
+// tasks executed in a row while there are tasks waiting in the low lane
+const maxLowPriorityDelay = 16
+
+// String returns the name of the priority and implements fmt.Stringer
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+
+	return "unknown"
+}
+
+// ParsePriority returns the priority with the given name
+func ParsePriority(name string) (Priority, error) {
+	for p := Priority(0); p < numPriorities; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown priority %q, expected high, normal or low", name)
+}
+
+// CheckPriority returns the priority passed as a string at index n. If
+// the argument is nil, PriorityNormal is returned
+func CheckPriority(L *lua.LState, n int) Priority {
+	name := L.OptString(n, PriorityNormal.String())
+
+	p, err := ParsePriority(name)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+
+	return p
+}
+
+// pop returns the next task to execute or nil if all lanes are empty.
+// Lanes are served in order of their priority but low priority tasks
+// are executed at least every maxLowPriorityDelay tasks
+func (l *loop) pop() *node {
+	low := l.lanes[PriorityLow]
+
+	if l.sinceLow >= maxLowPriorityDelay {
+		if n := low.popNode(); n != nil {
+			l.sinceLow = 0
+			return n
+		}
+	}
+
+	for _, p := range []Priority{PriorityHigh, PriorityNormal} {
+		if n := l.lanes[p].popNode(); n != nil {
+			if low.Len() > 0 {
+				l.sinceLow++
+			}
+			return n
+		}
+	}
+
+	l.sinceLow = 0
+	return low.popNode()
+}
+
+// next returns the next task to execute and blocks until a task becomes
+// available or ctx is cancelled. Tasks scheduled for a later time are queued
+// as soon as their deadline passed
+func (l *loop) next(ctx context.Context) (*node, error) {
+	for {
+		wait := l.fireTimers()
+
+		if n := l.pop(); n != nil {
+			return n, nil
+		}
+
+		var (
+			start   = time.Now()
+			timer   *time.Timer
+			timerCh <-chan time.Time
+		)
+
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timerCh = timer.C
+		}
+
+		select {
+		case <-l.lanes[PriorityHigh].Ready():
+		case <-l.lanes[PriorityNormal].Ready():
+		case <-l.lanes[PriorityLow].Ready():
+		case <-l.timers.changed:
+		case <-timerCh:
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		queueIdle.With(prometheus.Labels{"loop": "default", "queue": "all"}).Add(time.Since(start).Seconds())
+	}
+}
+
+// pending returns the number of tasks queued in all lanes
+func (l *loop) pending() int {
+	n := 0
+	for _, q := range l.lanes {
+		n += q.Len()
+	}
+
+	return n
+}
@@ -3,6 +3,7 @@ package loop
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -13,9 +14,81 @@ import (
 // but it is currently blocked
 var ErrQueueBlocked = errors.New("queue currently blocked")
 
+// ErrQueueFull is returned when a new item has been dropped because the
+// queue reached its capacity
+var ErrQueueFull = errors.New("queue is full")
+
+// OverflowPolicy defines what happens when a job is pushed to a queue
+// that reached its capacity
+type OverflowPolicy int
+
+const (
+	// PolicyBlock blocks the producer until there is room in the queue.
+	// Jobs scheduled from within the loop itself (e.g. by emitting a
+	// signal) ignore the capacity as the loop would otherwise wait for
+	// itself
+	PolicyBlock OverflowPolicy = iota
+
+	// PolicyDropOldest drops the oldest queued job to make room for
+	// the new one
+	PolicyDropOldest
+
+	// PolicyDropNewest drops the job that should be pushed
+	PolicyDropNewest
+
+	// PolicyCoalesce replaces the latest queued job with the same key
+	// (see PushKey) once the queue is full. If there is no job with the
+	// same key, the new job is dropped. Callbacks use a key per callback
+	// (and per key passed to Callback.DoKey) so a full queue keeps their
+	// pending invocations instead of the new one
+	PolicyCoalesce
+)
+
+// String returns the name of the policy and implements fmt.Stringer
+func (p OverflowPolicy) String() string {
+	switch p {
+	case PolicyBlock:
+		return "block"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyDropNewest:
+		return "drop-newest"
+	case PolicyCoalesce:
+		return "coalesce"
+	}
+
+	return "unknown"
+}
+
+// ParseOverflowPolicy returns the overflow policy with the given name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{PolicyBlock, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// QueueOptions configures the capacity of a queue
+type QueueOptions struct {
+	// Capacity is the maximum number of jobs queued. A value of zero
+	// means the queue is unbounded
+	Capacity int
+
+	// Policy defines what happens when the queue is full
+	Policy OverflowPolicy
+}
+
 type node struct {
 	data Task
+	key  string
 	next *node
+
+	// onDrop is called when the job is removed from the queue
+	// without being returned by Pop
+	onDrop func()
 }
 
 // Queue implements a job queue for the event loop
@@ -26,26 +99,40 @@ type Queue struct {
 	tail     *node
 	count    int
 	lock     *sync.Mutex
+	notFull  *sync.Cond
 	blocked  bool
 	waitCh   chan struct{}
+	opts     QueueOptions
 }
 
-// NewQueue creates a new queue
+// NewQueue creates a new unbounded queue
 func NewQueue(loopName, name string) *Queue {
+	return NewBoundedQueue(loopName, name, QueueOptions{})
+}
+
+// NewBoundedQueue creates a new queue that holds at most opts.Capacity
+// jobs
+func NewBoundedQueue(loopName, name string, opts QueueOptions) *Queue {
+	lock := &sync.Mutex{}
+
 	return &Queue{
-		lock:     &sync.Mutex{},
-		waitCh:   make(chan struct{}),
+		lock:     lock,
+		notFull:  sync.NewCond(lock),
+		waitCh:   make(chan struct{}, 1),
 		name:     name,
 		loopName: loopName,
+		opts:     opts,
 	}
 }
 
-// Block the queue and deny any push action. Pop will still work
+// Block the queue and deny any push action. Pop will still work.
+// Producers waiting for room in the queue return ErrQueueBlocked
 func (q *Queue) Block() {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
 	q.blocked = true
+	q.notFull.Broadcast()
 }
 
 // Unblock unblocks the queue and allows new items to be added
@@ -53,7 +140,15 @@ func (q *Queue) Unblock() {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.blocked = true
+	q.blocked = false
+}
+
+// IsBlocked returns true if the queue is currently blocked
+func (q *Queue) IsBlocked() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.blocked
 }
 
 // Len returns the number of jobs queued
@@ -64,8 +159,31 @@ func (q *Queue) Len() int {
 	return q.count
 }
 
-// Push pushes a new job onto the queue
+// Push pushes a new job onto the queue. If the queue is full, the
+// overflow policy of the queue is applied
 func (q *Queue) Push(item Task) error {
+	return q.push(&node{data: item}, false)
+}
+
+// PushKey pushes a new job identified by key onto the queue. If the
+// queue uses PolicyCoalesce and is full, the latest queued job with the
+// same key is replaced by item. For all other policies PushKey behaves
+// like Push
+func (q *Queue) PushKey(key string, item Task) error {
+	return q.push(&node{data: item, key: key}, false)
+}
+
+// push adds n to the queue. If force is true the capacity of the queue
+// is ignored
+func (q *Queue) push(n *node, force bool) error {
+	var drops []func()
+	defer func() {
+		// call drop handlers without holding the lock
+		for _, fn := range drops {
+			fn()
+		}
+	}()
+
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
@@ -73,7 +191,50 @@ func (q *Queue) Push(item Task) error {
 		return ErrQueueBlocked
 	}
 
-	n := &node{data: item}
+	full := !force && q.opts.Capacity > 0 && q.count >= q.opts.Capacity
+
+	if full && q.opts.Policy == PolicyCoalesce && n.key != "" {
+		var match *node
+		for c := q.head; c != nil; c = c.next {
+			if c.key == n.key {
+				match = c
+			}
+		}
+
+		if match != nil {
+			if match.onDrop != nil {
+				drops = append(drops, match.onDrop)
+			}
+			match.data = n.data
+			match.onDrop = n.onDrop
+			q.dropped()
+			return nil
+		}
+	}
+
+	if full {
+		switch q.opts.Policy {
+		case PolicyBlock:
+			for q.count >= q.opts.Capacity && !q.blocked {
+				q.notFull.Wait()
+			}
+
+			if q.blocked {
+				return ErrQueueBlocked
+			}
+
+		case PolicyDropOldest:
+			if old := q.remove(); old.onDrop != nil {
+				drops = append(drops, old.onDrop)
+			}
+			q.dropped()
+
+		default:
+			q.dropped()
+			return ErrQueueFull
+		}
+	}
+
 	if q.tail == nil {
 		q.tail = n
 		q.head = n
@@ -85,8 +246,9 @@ func (q *Queue) Push(item Task) error {
 	totalJobs.With(prometheus.Labels{"loop": q.loopName, "queue": q.name}).Inc()
 	queuedJobs.With(prometheus.Labels{"loop": q.loopName, "queue": q.name}).Inc()
 
-	// if there's someone waiting on PopWait(),
-	// try to notify it
+	// notify anyone waiting on PopWait() or Ready(). The
+	// channel is buffered so the notification is not lost
+	// if nobody is waiting right now
 	select {
 	case q.waitCh <- struct{}{}:
 	default:
@@ -95,12 +257,18 @@ func (q *Queue) Push(item Task) error {
 	return nil
 }
 
-// Pop returns the next task to execute from the queue or nil
-// if the queue is empty
-func (q *Queue) Pop() Task {
-	q.lock.Lock()
-	defer q.lock.Unlock()
+// dropped records a dropped job. The caller must hold the queue lock
+func (q *Queue) dropped() {
+	droppedJobs.With(prometheus.Labels{
+		"loop":   q.loopName,
+		"queue":  q.name,
+		"policy": q.opts.Policy.String(),
+	}).Inc()
+}
 
+// remove removes the head of the queue and returns it. The caller
+// must hold the queue lock
+func (q *Queue) remove() *node {
 	if q.head == nil {
 		return nil
 	}
@@ -114,9 +282,58 @@ func (q *Queue) Pop() Task {
 	q.count--
 	queuedJobs.With(prometheus.Labels{"loop": q.loopName, "queue": q.name}).Dec()
 
+	q.notFull.Signal()
+
+	return n
+}
+
+// Pop returns the next task to execute from the queue or nil
+// if the queue is empty
+func (q *Queue) Pop() Task {
+	n := q.popNode()
+	if n == nil {
+		return nil
+	}
+
 	return n.data
 }
 
+// popNode removes the head of the queue and returns it or nil if the
+// queue is empty
+func (q *Queue) popNode() *node {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.remove()
+}
+
+// Ready returns a channel that receives a value after a job has been
+// pushed to the queue. Receiving from the channel does not guarantee
+// that the queue is not empty, callers should always use Pop afterwards
+func (q *Queue) Ready() <-chan struct{} {
+	return q.waitCh
+}
+
+// Drain removes all jobs from the queue without executing them
+// and returns the number of jobs removed
+func (q *Queue) Drain() int {
+	q.lock.Lock()
+	var dropped []*node
+	for n := q.remove(); n != nil; n = q.remove() {
+		dropped = append(dropped, n)
+	}
+	q.lock.Unlock()
+
+	// call drop handlers without holding the lock
+	for _, n := range dropped {
+		if n.onDrop != nil {
+			n.onDrop()
+		}
+	}
+
+	return len(dropped)
+}
+
 // PopWait returns the next job from the queue and will
 // block until either the context is cancelled or a job
 // becomes available. If the queue is empty and blocked
@@ -0,0 +1,192 @@
+package loop
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runAll pops and executes all jobs in q and returns the number of executed jobs
+func runAll(q *Queue) int {
+	n := 0
+	for task := q.Pop(); task != nil; task = q.Pop() {
+		task(nil)
+		n++
+	}
+	return n
+}
+
+func Test_QueueBlockUnblock(t *testing.T) {
+	q := NewQueue("test", "jobs")
+
+	q.Block()
+	if err := q.Push(func(*lua.LState) {}); err != ErrQueueBlocked {
+		t.Errorf("expected ErrQueueBlocked but got %v", err)
+	}
+
+	q.Unblock()
+	if err := q.Push(func(*lua.LState) {}); err != nil {
+		t.Errorf("expected push to succeed after Unblock but got %v", err)
+	}
+}
+
+func Test_QueueDropPolicies(t *testing.T) {
+	var got []int
+
+	push := func(q *Queue, i int) error {
+		return q.Push(func(*lua.LState) { got = append(got, i) })
+	}
+
+	q := NewBoundedQueue("test", "jobs", QueueOptions{Capacity: 2, Policy: PolicyDropOldest})
+	for i := 0; i < 4; i++ {
+		if err := push(q, i); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	runAll(q)
+
+	if len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("expected the oldest jobs to be dropped but got %v", got)
+	}
+
+	got = nil
+	q = NewBoundedQueue("test", "jobs", QueueOptions{Capacity: 2, Policy: PolicyDropNewest})
+	for i := 0; i < 4; i++ {
+		err := push(q, i)
+		if i >= 2 && err != ErrQueueFull {
+			t.Errorf("expected ErrQueueFull for job %d but got %v", i, err)
+		}
+	}
+	runAll(q)
+
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("expected the newest jobs to be dropped but got %v", got)
+	}
+}
+
+func Test_QueueCoalesce(t *testing.T) {
+	var got []string
+
+	q := NewBoundedQueue("test", "jobs", QueueOptions{Capacity: 2, Policy: PolicyCoalesce})
+	for _, v := range []string{"a1", "b1", "a2", "a3"} {
+		v := v
+		if err := q.PushKey(v[:1], func(*lua.LState) { got = append(got, v) }); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	if err := q.PushKey("c", func(*lua.LState) {}); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull but got %v", err)
+	}
+
+	runAll(q)
+
+	if len(got) != 2 || got[0] != "a3" || got[1] != "b1" {
+		t.Errorf("expected [a3 b1] but got %v", got)
+	}
+}
+
+func Test_QueueBlockPolicy(t *testing.T) {
+	q := NewBoundedQueue("test", "jobs", QueueOptions{Capacity: 1, Policy: PolicyBlock})
+	q.Push(func(*lua.LState) {})
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.Push(func(*lua.LState) {})
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("expected the producer to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Pop()
+
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the producer to continue")
+	}
+
+	// blocking the queue releases waiting producers
+	go func() {
+		pushed <- q.Push(func(*lua.LState) {})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Block()
+
+	if err := <-pushed; err != ErrQueueBlocked {
+		t.Errorf("expected ErrQueueBlocked but got %v", err)
+	}
+}
+
+func Test_LoopBoundedQueue(t *testing.T) {
+	l, err := New(&Options{
+		Queue: QueueOptions{Capacity: 1, Policy: PolicyDropNewest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the queue before the loop is started
+	l.Schedule(func(*lua.LState) {})
+
+	// a dropped task must not block ScheduleAndWait or Wait
+	done := make(chan struct{})
+	go func() {
+		l.ScheduleAndWait(func(*lua.LState) {})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ScheduleAndWait blocked on a dropped task")
+	}
+
+	l.Start(context.Background())
+	l.Stop()
+	l.Wait()
+}
+
+func Test_LoopBlockPolicySelfSchedule(t *testing.T) {
+	l, err := New(&Options{
+		Queue: QueueOptions{Capacity: 1, Policy: PolicyBlock},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Start(context.Background())
+
+	// tasks scheduled by the loop itself must not wait for room
+	// that only the loop can free
+	count := 0
+	done := make(chan struct{})
+	l.Schedule(func(*lua.LState) {
+		for i := 0; i < 5; i++ {
+			l.Schedule(func(*lua.LState) {
+				count++
+			})
+		}
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the loop blocked on its own lane")
+	}
+
+	l.Stop()
+	l.Wait()
+
+	if count != 5 {
+		t.Errorf("expected 5 tasks to be executed but got %d", count)
+	}
+}
@@ -0,0 +1,189 @@
+package loop
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timerEntry is a task that should be moved to the lane for priority
+// once its deadline passed
+type timerEntry struct {
+	at       time.Time
+	priority Priority
+	task     Task
+	handle   *handle
+	index    int
+}
+
+// timerHeap is a min-heap of timer entries ordered by their deadline and
+// implements heap.Interface
+type timerHeap []*timerEntry
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	e := x.(*timerEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// timers holds all tasks scheduled via ScheduleAt and ScheduleAfter. The
+// loop waits for the earliest deadline itself so there is no goroutine
+// per timer
+type timers struct {
+	lock    sync.Mutex
+	heap    timerHeap
+	stopped bool
+
+	// changed receives a value when a new entry becomes the
+	// earliest one
+	changed chan struct{}
+}
+
+func newTimers() *timers {
+	return &timers{
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// add adds a new entry and notifies the loop if it's the earliest one.
+// It returns false if the timers have already been stopped
+func (t *timers) add(e *timerEntry) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.stopped {
+		return false
+	}
+
+	heap.Push(&t.heap, e)
+	pendingTimers.With(prometheus.Labels{"loop": "default"}).Inc()
+
+	if e.index == 0 {
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+
+	return true
+}
+
+// remove removes e if it is still pending so cancelled entries do not
+// stay in the heap until their deadline
+func (t *timers) remove(e *timerEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if e.index < 0 || e.index >= len(t.heap) || t.heap[e.index] != e {
+		return
+	}
+
+	heap.Remove(&t.heap, e.index)
+	pendingTimers.With(prometheus.Labels{"loop": "default"}).Dec()
+}
+
+// due removes and returns all entries whose deadline passed. It also returns
+// the duration until the next deadline or -1 if there are no more entries
+func (t *timers) due(now time.Time) ([]*timerEntry, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var entries []*timerEntry
+	for len(t.heap) > 0 && !t.heap[0].at.After(now) {
+		entries = append(entries, heap.Pop(&t.heap).(*timerEntry))
+		pendingTimers.With(prometheus.Labels{"loop": "default"}).Dec()
+	}
+
+	if len(t.heap) == 0 {
+		return entries, -1
+	}
+
+	return entries, t.heap[0].at.Sub(now)
+}
+
+// stop removes all entries and denies adding new ones. The handles of
+// all entries removed are marked as dropped
+func (t *timers) stop() {
+	t.lock.Lock()
+	entries := t.heap
+	t.heap = nil
+	t.stopped = true
+	t.lock.Unlock()
+
+	for _, e := range entries {
+		e.handle.finish(ErrTaskDropped)
+		pendingTimers.With(prometheus.Labels{"loop": "default"}).Dec()
+	}
+}
+
+// ScheduleAt schedules task to be executed at the given time. The task is
+// queued in the normal lane once the deadline passed. Cancelling the returned
+// handle prevents the task from being executed. Pending tasks are dropped when
+// the loop is stopped
+func (l *loop) ScheduleAt(at time.Time, task Task) Handle {
+	return l.ScheduleAtWithPriority(at, PriorityNormal, task)
+}
+
+// ScheduleAtWithPriority works like ScheduleAt but queues task in the lane
+// for priority
+func (l *loop) ScheduleAtWithPriority(at time.Time, priority Priority, task Task) Handle {
+	h := newHandle()
+	e := &timerEntry{at: at, priority: priority, task: task, handle: h}
+
+	if !l.timers.add(e) {
+		h.finish(ErrTaskDropped)
+		return h
+	}
+
+	h.OnDone(func() {
+		l.timers.remove(e)
+	})
+
+	return h
+}
+
+// ScheduleAfter schedules task to be executed after d. See ScheduleAt
+func (l *loop) ScheduleAfter(d time.Duration, task Task) Handle {
+	return l.ScheduleAt(time.Now().Add(d), task)
+}
+
+// fireTimers moves all due timer tasks to their lanes and returns the
+// duration until the next deadline
+func (l *loop) fireTimers() time.Duration {
+	entries, next := l.timers.due(time.Now())
+
+	for _, e := range entries {
+		// cancelled entries do not need to be queued at all
+		select {
+		case <-e.handle.Done():
+			continue
+		default:
+		}
+
+		l.push(e.priority, "", e.handle, e.task, false)
+	}
+
+	return next
+}
@@ -0,0 +1,78 @@
+package signal
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+const connectionTypeName = "signal_connection"
+
+var connectionTypeAPI = map[string]lua.LGFunction{
+	"disconnect":   connectionDisconnect,
+	"is_connected": connectionIsConnected,
+}
+
+// Connection is returned when connecting a handler to a signal
+type Connection interface {
+	// Disconnect removes the handler. It returns false if the handler
+	// has already been disconnected
+	Disconnect() bool
+
+	// Connected returns true if the handler is still connected. One-shot
+	// handlers are disconnected once the signal has been emitted
+	Connected() bool
+}
+
+func (s *subscription) Disconnect() bool {
+	s.sig.lock.Lock()
+	defer s.sig.lock.Unlock()
+
+	return s.sig.removeLocked(s)
+}
+
+func (s *subscription) Connected() bool {
+	s.sig.lock.RLock()
+	defer s.sig.lock.RUnlock()
+
+	for _, other := range s.sig.subscriptions(s.name)[s.name] {
+		if other == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newConnection(L *lua.LState, c Connection) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = c
+	L.SetMetatable(ud, L.GetTypeMetatable(connectionTypeName))
+
+	return ud
+}
+
+func checkConnection(L *lua.LState) Connection {
+	ud := L.CheckUserData(1)
+	if c, ok := ud.Value.(Connection); ok {
+		return c
+	}
+
+	L.ArgError(1, "expected a signal connection")
+	return nil
+}
+
+// connectionDisconnect provides `connection:disconnect()` and returns true
+// if the handler has been connected
+func connectionDisconnect(L *lua.LState) int {
+	c := checkConnection(L)
+
+	L.Push(lua.LBool(c.Disconnect()))
+	return 1
+}
+
+// connectionIsConnected provides `connection:is_connected()`
+func connectionIsConnected(L *lua.LState) int {
+	c := checkConnection(L)
+
+	L.Push(lua.LBool(c.Connected()))
+	return 1
+}
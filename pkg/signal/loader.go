@@ -1,6 +1,7 @@
 package signal
 
 import (
+	"github.com/ppacher/envel/pkg/loop"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -28,6 +29,7 @@ func Loader(L *lua.LState) int {
 	t := L.RegisterModule("__signal", map[string]lua.LGFunction{}).(*lua.LTable)
 
 	createSignalTypeMetatable(L, t)
+	extendLoop(L)
 
 	L.SetMetatable(t, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"__call": newSignal,
@@ -36,3 +38,29 @@ func Loader(L *lua.LState) int {
 	L.Push(t)
 	return 1
 }
+
+// extendLoop adds signal methods to the __loop global and emits all
+// loop events (e.g. loop::job_timeout) as signals on it
+func extendLoop(L *lua.LState) {
+	ud, ok := L.GetGlobal("__loop").(*lua.LUserData)
+	if !ok {
+		return
+	}
+
+	// the loop may already be extended if the library is opened twice
+	if _, err := GetSignal(L, ud); err == nil {
+		return
+	}
+
+	_, sig := Extend(L, ud)
+	loop.LGet(L).OnEvent(func(name string, args ...lua.LValue) {
+		sig.EmitFrom(name, func(L *lua.LState) []lua.LValue {
+			// handlers of the error event, including the ones
+			// subscribed using a pattern, must not trigger it again
+			if name == loop.ErrorEvent {
+				loop.MarkErrorDelivery(L)
+			}
+			return args
+		})
+	})
+}
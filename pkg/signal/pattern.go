@@ -0,0 +1,43 @@
+package signal
+
+import "strings"
+
+// IsPattern returns true if name contains glob characters. Patterns may use
+// `*` to match any sequence of characters (including "::") and `?` to match
+// a single character
+func IsPattern(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+// MatchPattern reports whether name matches the glob pattern
+func MatchPattern(pattern, name string) bool {
+	// position to continue from after the last `*`
+	star, next := -1, 0
+
+	p, n := 0, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, n
+			p++
+
+		case star >= 0:
+			// let the last `*` consume one more character
+			next++
+			p, n = star+1, next
+
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
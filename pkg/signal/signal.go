@@ -1,10 +1,13 @@
 package signal
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/ppacher/envel/pkg/callback"
+	"github.com/ppacher/envel/pkg/loop"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -16,26 +19,61 @@ func createSignalTypeMetatable(L *lua.LState, t *lua.LTable) {
 	L.SetField(t, "__signal_mt", mt)
 
 	L.SetField(t, "extend", L.NewFunction(signalExtend))
+
+	connMt := L.NewTypeMetatable(connectionTypeName)
+	L.SetField(connMt, "__index", L.SetFuncs(L.NewTable(), connectionTypeAPI))
+	L.SetField(t, "__connection_mt", connMt)
 }
 
 var signalTypeAPI = map[string]lua.LGFunction{
-	"connect_signal":    signalConnect,
-	"disconnect_signal": signalDisconnect,
-	"emit_signal":       signalEmit,
-	"topics":            signalTopics,
-	"subscribers":       signalSubscribers,
+	"connect_signal":      signalConnect,
+	"connect_signal_once": signalConnectOnce,
+	"disconnect_signal":   signalDisconnect,
+	"disconnect_all":      signalDisconnectAll,
+	"emit_signal":         signalEmit,
+	"emit_signal_sync":    signalEmitSync,
+	"topics":              signalTopics,
+	"subscribers":         signalSubscribers,
 }
 
 // Signal provides a singal framework for lua
 type Signal struct {
 	lock      sync.RWMutex
-	listeners map[string][]callback.Callback
+	listeners map[string][]*subscription
+
+	// patterns holds subscriptions for glob patterns like "property::*"
+	patterns map[string][]*subscription
+
+	// seq is increased for each subscription to keep handlers with the
+	// same priority in the order they have been connected
+	seq uint64
+
+	// deliveries holds the delivery mode of signals (see SetDelivery)
+	deliveries map[string]callback.Delivery
+}
+
+// subscription is a handler connected to a signal or pattern
+type subscription struct {
+	sig      *Signal
+	name     string
+	handler  callback.Callback
+	priority int
+	seq      uint64
+	pattern  bool
+
+	// once subscriptions are removed before their first delivery
+	once bool
+
+	// delivered holds the handler invoked using the delivery mode
+	// of each signal with a delivery mode. See SetDelivery
+	delivered map[string]callback.Callback
 }
 
 // NewSignal creates a new signal for the lua VM
 func NewSignal(L *lua.LState) (*lua.LUserData, *Signal) {
 	sig := &Signal{
-		listeners: make(map[string][]callback.Callback),
+		listeners: make(map[string][]*subscription),
+		patterns:  make(map[string][]*subscription),
 	}
 
 	ud := L.NewUserData()
@@ -141,17 +179,63 @@ func newSignal(L *lua.LState) int {
 	return 1
 }
 
+// signalConnect provides `connect_signal(name, handler, [priority])`. If name
+// is a glob pattern (see IsPattern) the handler is called for each matching
+// signal and receives the name of the emitted signal as its first argument.
+// Handlers with a higher priority are called first (defaults to 0). It returns
+// a connection handle that can be used to disconnect the handler
 func signalConnect(L *lua.LState) int {
+	return connect(L, false)
+}
+
+// signalConnectOnce works like signalConnect but disconnects the handler
+// after the first delivery
+func signalConnectOnce(L *lua.LState) int {
+	return connect(L, true)
+}
+
+func connect(L *lua.LState, once bool) int {
 	sig := checkSignal(L)
 	name := L.CheckString(2)
-	handler := callback.LGet(3, L)
+	handler := callback.New(L.CheckFunction(3), loop.LGet(L), callback.WithOrigin("signal:"+name))
+	priority := L.OptInt(4, 0)
+
+	s := sig.Connect(name, handler, priority, once)
+
+	L.Push(newConnection(L, s))
+	return 1
+}
 
+// Connect subscribes handler to the signal or pattern name. See signalConnect
+func (sig *Signal) Connect(name string, handler callback.Callback, priority int, once bool) Connection {
 	sig.lock.Lock()
 	defer sig.lock.Unlock()
 
-	sig.listeners[name] = append(sig.listeners[name], handler)
+	sig.seq++
 
-	return 0
+	s := &subscription{
+		sig:      sig,
+		name:     name,
+		handler:  handler,
+		priority: priority,
+		seq:      sig.seq,
+		pattern:  IsPattern(name),
+		once:     once,
+	}
+
+	subscriptions := sig.subscriptions(name)
+	subscriptions[name] = append(subscriptions[name], s)
+
+	return s
+}
+
+// subscriptions returns the map that holds the subscriptions for name
+func (sig *Signal) subscriptions(name string) map[string][]*subscription {
+	if IsPattern(name) {
+		return sig.patterns
+	}
+
+	return sig.listeners
 }
 
 func signalDisconnect(L *lua.LState) int {
@@ -162,25 +246,87 @@ func signalDisconnect(L *lua.LState) int {
 	sig.lock.Lock()
 	defer sig.lock.Unlock()
 
-	handlers := sig.listeners[name]
 	// find the actual callback value
-	for i := 0; i < len(handlers); i++ {
-		if handlers[i].Callable() != handler {
-			continue
+	for _, s := range sig.subscriptions(name)[name] {
+		if s.handler.Callable() == handler {
+			sig.removeLocked(s)
+			break
 		}
+	}
+
+	return 0
+}
 
-		copy(handlers[i:], handlers[i+1:])
-		handlers[len(handlers)-1] = nil
-		handlers = handlers[:len(handlers)-1]
+// signalDisconnectAll provides `disconnect_all([name])` and removes all
+// handlers of the signal or pattern name. If name is omitted all handlers
+// are removed. It returns the number of removed handlers
+func signalDisconnectAll(L *lua.LState) int {
+	sig := checkSignal(L)
+
+	var n int
+	if L.Get(2) == lua.LNil {
+		n = sig.DisconnectAll()
+	} else {
+		n = sig.DisconnectAll(L.CheckString(2))
+	}
 
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+// DisconnectAll removes all handlers of the passed signals or patterns. If
+// no topic is passed all handlers are removed. It returns the number of
+// removed handlers
+func (sig *Signal) DisconnectAll(topics ...string) int {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	n := 0
+
+	if len(topics) == 0 {
+		for _, handlers := range sig.listeners {
+			n += len(handlers)
+		}
+		for _, handlers := range sig.patterns {
+			n += len(handlers)
+		}
+
+		sig.listeners = make(map[string][]*subscription)
+		sig.patterns = make(map[string][]*subscription)
+		return n
+	}
+
+	for _, topic := range topics {
+		subscriptions := sig.subscriptions(topic)
+		n += len(subscriptions[topic])
+		delete(subscriptions, topic)
+	}
+
+	return n
+}
+
+// removeLocked removes s and returns true if it has still been connected.
+// It must be called with sig.lock held
+func (sig *Signal) removeLocked(s *subscription) bool {
+	subscriptions := sig.subscriptions(s.name)
+	handlers := subscriptions[s.name]
+
+	for i := range handlers {
+		if handlers[i] != s {
+			continue
+		}
+
+		handlers = append(handlers[:i:i], handlers[i+1:]...)
 		if len(handlers) == 0 {
-			delete(sig.listeners, name)
+			delete(subscriptions, s.name)
+		} else {
+			subscriptions[s.name] = handlers
 		}
 
-		break
+		return true
 	}
 
-	return 0
+	return false
 }
 
 func signalTopics(L *lua.LState) int {
@@ -205,48 +351,171 @@ func signalSubscribers(L *lua.LState) int {
 	return 1
 }
 
-// Topics returns a slice of topics that have been subscribed
+// Topics returns a slice of topics and patterns that have been subscribed
 func (sig *Signal) Topics() []string {
 	sig.lock.RLock()
 	defer sig.lock.RUnlock()
 
-	topic := make([]string, len(sig.listeners))
-	i := 0
+	topic := make([]string, 0, len(sig.listeners)+len(sig.patterns))
 	for name := range sig.listeners {
-		topic[i] = name
-		i++
+		topic = append(topic, name)
+	}
+	for pattern := range sig.patterns {
+		topic = append(topic, pattern)
 	}
 
 	return topic
 }
 
-// Listeners returns the number of subscribers for a given topic
+// Listeners returns the number of subscribers for a given topic including
+// subscribers of matching patterns. If topic is a pattern the number of
+// subscribers of that pattern is returned
 func (sig *Signal) Listeners(topic string) int {
 	sig.lock.RLock()
 	defer sig.lock.RUnlock()
 
-	return len(sig.listeners[topic])
+	if IsPattern(topic) {
+		return len(sig.patterns[topic])
+	}
+
+	count := len(sig.listeners[topic])
+	for pattern, handlers := range sig.patterns {
+		if MatchPattern(pattern, topic) {
+			count += len(handlers)
+		}
+	}
+
+	return count
+}
+
+// matching returns all subscriptions that receive the signal name ordered
+// by priority and the order they have been connected. One-shot subscriptions
+// are removed so they are delivered only once
+func (sig *Signal) matching(name string) []*subscription {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	res := append([]*subscription(nil), sig.listeners[name]...)
+	for pattern, handlers := range sig.patterns {
+		if MatchPattern(pattern, name) {
+			res = append(res, handlers...)
+		}
+	}
+
+	for _, s := range res {
+		if s.once {
+			sig.removeLocked(s)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].priority != res[j].priority {
+			return res[i].priority > res[j].priority
+		}
+		return res[i].seq < res[j].seq
+	})
+
+	return res
+}
+
+// args returns the arguments for the subscription. Pattern subscriptions
+// receive the name of the signal as the first argument
+func (s *subscription) args(name string, args []lua.LValue) []lua.LValue {
+	if !s.pattern {
+		return args
+	}
+
+	return append([]lua.LValue{lua.LString(name)}, args...)
+}
+
+// SetDelivery configures how emissions of the signal name are delivered to
+// each subscriber, including the ones of matching patterns (see
+// callback.Delivery). Emissions are coalesced by the name of the signal
+func (sig *Signal) SetDelivery(name string, d callback.Delivery) {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	if sig.deliveries == nil {
+		sig.deliveries = make(map[string]callback.Delivery)
+	}
+	sig.deliveries[name] = d
+
+	for _, subscriptions := range []map[string][]*subscription{sig.listeners, sig.patterns} {
+		for _, list := range subscriptions {
+			for _, s := range list {
+				delete(s.delivered, name)
+			}
+		}
+	}
+}
+
+// handlerFor returns the handler of s that delivers the signal name
+func (sig *Signal) handlerFor(s *subscription, name string) callback.Callback {
+	sig.lock.Lock()
+	defer sig.lock.Unlock()
+
+	d, ok := sig.deliveries[name]
+	if !ok {
+		return s.handler
+	}
+
+	if h, ok := s.delivered[name]; ok {
+		return h
+	}
+
+	if s.delivered == nil {
+		s.delivered = make(map[string]callback.Callback)
+	}
+
+	h := callback.Deliver(s.handler, d)
+	s.delivered[name] = h
+
+	return h
 }
 
 // Emit emits a new signal to any subscriber
 func (sig *Signal) Emit(name string, args ...lua.LValue) {
-	sig.lock.RLock()
-	defer sig.lock.RUnlock()
-	for _, cb := range sig.listeners[name] {
-		cb.Do(args...)
-	}
+	sig.EmitFrom(name, func(*lua.LState) []lua.LValue {
+		return args
+	})
 }
 
 // EmitFrom emits a signal to any subscriber using the returnd value slice
-// as spreaded parameters
+// as spreaded parameters. Subscribers of matching patterns receive the name
+// of the signal as an additional first parameter. Each subscriber is
+// scheduled as a separate task in the order of their priority using the
+// delivery mode of the signal (see SetDelivery)
 func (sig *Signal) EmitFrom(name string, fn func(*lua.LState) []lua.LValue) {
-	sig.lock.RLock()
-	defer sig.lock.RUnlock()
-	for _, cb := range sig.listeners[name] {
-		cb.From(fn)
+	for _, s := range sig.matching(name) {
+		s := s
+		sig.handlerFor(s, name).FromKey(name, func(L *lua.LState) []lua.LValue {
+			return s.args(name, fn(L))
+		})
 	}
 }
 
+// EmitSync calls all subscribers of the signal name immediately in the order
+// of their priority and must only be called on the loop using L. If a handler
+// returns false as its first value the remaining handlers are skipped and
+// stopped is true. The values returned by each called handler are collected
+// in results. Handlers that fail are reported and skipped
+func (sig *Signal) EmitSync(L *lua.LState, name string, args ...lua.LValue) (results [][]lua.LValue, stopped bool) {
+	for _, s := range sig.matching(name) {
+		res, err := s.handler.Call(context.Background(), L, s.args(name, args)...)
+		if err != nil {
+			continue
+		}
+
+		results = append(results, res.Values)
+
+		if len(res.Values) > 0 && res.Values[0] == lua.LFalse {
+			return results, true
+		}
+	}
+
+	return results, false
+}
+
 func signalExtend(L *lua.LState) int {
 	table := L.CheckTable(1)
 
@@ -269,3 +538,31 @@ func signalEmit(L *lua.LState) int {
 	sig.Emit(name, args...)
 	return 0
 }
+
+// signalEmitSync provides `emit_signal_sync(name, ...)`. See EmitSync. It
+// returns a list with a table of the values returned by each handler and
+// whether propagation has been stopped
+func signalEmitSync(L *lua.LState) int {
+	sig := checkSignal(L)
+	name := L.CheckString(2)
+	args := make([]lua.LValue, L.GetTop()-2)
+
+	for i := 0; i < L.GetTop()-2; i++ {
+		args[i] = L.Get(i + 3)
+	}
+
+	results, stopped := sig.EmitSync(L, name, args...)
+
+	tbl := L.NewTable()
+	for _, values := range results {
+		t := L.NewTable()
+		for i, v := range values {
+			t.RawSetInt(i+1, v)
+		}
+		tbl.Append(t)
+	}
+
+	L.Push(tbl)
+	L.Push(lua.LBool(stopped))
+	return 2
+}
@@ -0,0 +1,306 @@
+package signal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ppacher/envel/pkg/callback"
+	helper "github.com/ppacher/envel/pkg/testing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func Test_MatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"property::*", "property::brightness", true},
+		{"property::*", "property::", true},
+		{"property::*", "state::on", false},
+		{"*::on", "state::on", true},
+		{"*::on", "state::off", false},
+		{"store::changed::*::key", "store::changed::ns::key", true},
+		{"store::changed::*::key", "store::changed::ns::other", false},
+		{"state::o?", "state::on", true},
+		{"state::o?", "state::off", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+	}
+
+	for _, c := range cases {
+		if got := MatchPattern(c.pattern, c.name); got != c.match {
+			t.Errorf("MatchPattern(%q, %q): expected %v but got %v", c.pattern, c.name, c.match, got)
+		}
+	}
+}
+
+func Test_PatternSubscription(t *testing.T) {
+	l, done := helper.GetTestLoop(t, OpenSignal)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local sig = __signal()
+		local received = {}
+
+		local function handler(name, value)
+			table.insert(received, name.."="..tostring(value))
+			if #received == 2 then
+				assert(received[1] == "property::brightness=10")
+				assert(received[2] == "property::color=red")
+				done()
+			end
+		end
+
+		sig:connect_signal("property::*", handler)
+		sig:connect_signal("property::brightness", function(value)
+			assert(value == 10)
+		end)
+
+		assert(sig:subscribers("property::*") == 1)
+		assert(sig:subscribers("property::brightness") == 2)
+		assert(sig:subscribers("property::color") == 1)
+		assert(sig:subscribers("state::on") == 0)
+		assert(#sig:topics() == 2)
+
+		sig:emit_signal("state::on", true)
+		sig:emit_signal("property::brightness", 10)
+		sig:emit_signal("property::color", "red")
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("pattern handler has not been called")
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local sig = __signal()
+		local fn = function() end
+
+		sig:connect_signal("*", fn)
+		sig:connect_signal("*", function() end)
+		sig:disconnect_signal("*", fn)
+		assert(sig:subscribers("*") == 1)
+		assert(sig:subscribers("foo") == 1)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_EmitSync(t *testing.T) {
+	l, _ := helper.GetTestLoop(t, OpenSignal)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local sig = __signal()
+		local calls = {}
+
+		sig:connect_signal("check", function(v)
+			table.insert(calls, "low")
+			return "low"
+		end, -1)
+		sig:connect_signal("check", function(v)
+			table.insert(calls, "default")
+			return "default", v
+		end)
+		sig:connect_signal("check*", function(name, v)
+			table.insert(calls, "pattern")
+			return name
+		end)
+		sig:connect_signal("check", function(v)
+			table.insert(calls, "high")
+			return nil, v
+		end, 10)
+
+		local results, stopped = sig:emit_signal_sync("check", 42)
+		assert(not stopped)
+		assert(table.concat(calls, ",") == "high,default,pattern,low", table.concat(calls, ","))
+		assert(#results == 4)
+		assert(results[1][1] == nil and results[1][2] == 42)
+		assert(results[2][1] == "default" and results[2][2] == 42)
+		assert(results[3][1] == "check")
+
+		-- returning false stops propagation
+		calls = {}
+		sig:connect_signal("check", function()
+			table.insert(calls, "veto")
+			return false
+		end, 5)
+
+		results, stopped = sig:emit_signal_sync("check", 1)
+		assert(stopped)
+		assert(#results == 2)
+		assert(table.concat(calls, ",") == "high,veto", table.concat(calls, ","))
+
+		-- failing handlers are skipped
+		local s2 = __signal()
+		s2:connect_signal("fail", function() local x = nil; x() end, 1)
+		s2:connect_signal("fail", function() return "ok" end)
+		results, stopped = s2:emit_signal_sync("fail")
+		assert(#results == 1 and results[1][1] == "ok")
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_Connections(t *testing.T) {
+	l, done := helper.GetTestLoop(t, OpenSignal)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		err := L.DoString(`
+		local sig = __signal()
+		once_calls = 0
+
+		local conn = sig:connect_signal("a", function() end)
+		assert(conn:is_connected())
+		assert(sig:subscribers("a") == 1)
+		assert(conn:disconnect())
+		assert(not conn:is_connected())
+		assert(not conn:disconnect())
+		assert(sig:subscribers("a") == 0)
+
+		local once = sig:connect_signal_once("b", function() once_calls = once_calls + 1 end)
+		sig:emit_signal("b")
+		sig:emit_signal("b")
+		assert(not once:is_connected())
+
+		local results = sig:emit_signal_sync("b")
+		assert(#results == 0)
+
+		sig:connect_signal("c", function() end)
+		sig:connect_signal("c", function() end)
+		sig:connect_signal("c*", function() end)
+		sig:connect_signal("d", function() end)
+		assert(sig:disconnect_all("c") == 2)
+		assert(sig:subscribers("c") == 1)
+		assert(sig:disconnect_all() == 2)
+		assert(#sig:topics() == 0)
+
+		__schedule(function() done() end)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if err := L.DoString(`assert(once_calls == 1, "expected one call but got "..once_calls)`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_SignalDelivery(t *testing.T) {
+	l, _ := helper.GetTestLoop(t, OpenSignal)
+
+	var sig *Signal
+	release := make(chan struct{})
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		ud, s := NewSignal(L)
+		sig = s
+		L.SetGlobal("sig", ud)
+
+		err := L.DoString(`
+		first = {}
+		second = {}
+
+		sig:connect_signal("value", function(v) table.insert(first, v) end)
+		sig:connect_signal("value", function(v) table.insert(second, v) end)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+
+		sig.SetDelivery("value", callback.Delivery{Coalesce: true})
+	})
+
+	// block the loop so all values are emitted while the first one
+	// is in flight
+	l.Schedule(func(*lua.LState) {
+		<-release
+	})
+
+	for i := 1; i <= 4; i++ {
+		sig.Emit("value", lua.LNumber(i))
+	}
+	close(release)
+
+	time.Sleep(50 * time.Millisecond)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		for _, name := range []string{"first", "second"} {
+			values := L.GetGlobal(name).(*lua.LTable)
+			if values.Len() != 2 || values.RawGetInt(1) != lua.LNumber(1) || values.RawGetInt(2) != lua.LNumber(4) {
+				t.Errorf("expected each subscriber to receive 1 and 4 but %s got %d values", name, values.Len())
+			}
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
+
+func Test_ErrorEventPattern(t *testing.T) {
+	l, _ := helper.GetTestLoop(t, OpenSignal)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		// a failing handler subscribed by pattern receives the error
+		// event but must not trigger it again
+		err := L.DoString(`
+		calls = 0
+
+		__loop:connect_signal("*", function(name)
+			calls = calls + 1
+			local x = nil
+			x.fail = true
+		end)
+
+		__schedule(function()
+			local x = nil
+			x.fail = true
+		end)
+		`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+
+	l.ScheduleAndWait(func(L *lua.LState) {
+		if calls := L.GetGlobal("calls"); calls != lua.LNumber(1) {
+			t.Errorf("expected the handler to be called once but got %v", calls)
+		}
+	})
+
+	l.Stop()
+	l.Wait()
+}
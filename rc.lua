@@ -60,6 +60,24 @@ on_exit(function()
     print("good bye")
 end)
 
+-- get notified whenever an automation fails
+require("envel.loop"):connect_signal("envel::error", function(message, source, traceback, origin)
+    notify{title = "envel: automation failed", text = source.." ("..origin.."): "..message}
+end)
+
+-- async() starts a task that can wait for asynchronous operations using await()
+-- and sleep() without blocking the event loop. await() accepts pending operations
+-- returned by native bindings or a function that receives a callback
+--[[
+async(function()
+    plug:turn_on()
+    sleep(5 * 60)
+
+    local realtime = await(plug:realtime())
+    notify{title = "laundry", text = "current power: "..tostring(realtime.power).."W"}
+end)
+--]]
+
 local notifier = new_pushover({
     user  = config.pushover.user,
     key = config.pushover.key,